@@ -0,0 +1,200 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/IBM/sarama"
+	"github.com/go-chi/chi"
+)
+
+// partitionStatus — смещения consumer group в одной партиции
+type partitionStatus struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	// закоммиченное смещение группы, -1 если группа еще ничего не коммитила
+	CommittedOffset int64 `json:"committed_offset"`
+	HighWaterMark   int64 `json:"high_water_mark"`
+	Lag             int64 `json:"lag"`
+}
+
+// memberStatus — участник consumer group и назначенные ему партиции
+type memberStatus struct {
+	MemberID    string             `json:"member_id"`
+	ClientID    string             `json:"client_id"`
+	ClientHost  string             `json:"client_host"`
+	Assignments map[string][]int32 `json:"assignments"`
+}
+
+type groupStatus struct {
+	Group      string            `json:"group"`
+	State      string            `json:"state"`
+	Partitions []partitionStatus `json:"partitions"`
+	Members    []memberStatus    `json:"members"`
+}
+
+// mountAdminRoutes регистрирует служебные эндпоинты /admin. Они доступны только с
+// ADMIN_AUTH_TOKEN; без него маршруты не регистрируются вовсе
+func mountAdminRoutes(api chi.Router, cfg Config, config *sarama.Config, queue *asyncQueue, consumer *Consumer) {
+	if cfg.AdminAuthToken == "" {
+		return
+	}
+	api.Route("/admin", func(admin chi.Router) {
+		admin.Use(requireBearerToken(cfg.AdminAuthToken))
+
+		// текущие смещения, lag по партициям и участники группы, только чтение
+		admin.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+			status, err := fetchGroupStatus(cfg, config)
+			if err != nil {
+				writeJSONError(w, r, http.StatusBadGateway, fmt.Sprintf("Error fetching consumer status: %v", err))
+				return
+			}
+			writeJSON(w, r, http.StatusOK, status)
+		})
+
+		// действующие настройки с теми же скрытыми секретами, что и в логе при запуске
+		admin.Get("/config", func(w http.ResponseWriter, r *http.Request) {
+			settings := make(map[string]string)
+			for _, setting := range cfg.Settings() {
+				settings[setting.Key] = setting.Value
+			}
+			writeJSON(w, r, http.StatusOK, settings)
+		})
+
+		// очередь POST /facts?async=true: глубина и возраст самого старого сообщения
+		admin.Get("/buffer", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, r, http.StatusOK, queue.status())
+		})
+
+		// отправить очередь сейчас, не дожидаясь фоновой горутины
+		admin.Post("/buffer/flush", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, r, http.StatusOK, queue.flush(r.Context()))
+		})
+
+		// повторная отправка диапазона смещений одной партиции через обычный sink
+		admin.Post("/replay", func(w http.ResponseWriter, r *http.Request) {
+			var request replayRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeJSONError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid replay request: %v", err))
+				return
+			}
+			if request.Topic == "" {
+				request.Topic = cfg.ProduceTopic()
+			}
+
+			result, err := replayRange(r.Context(), cfg, config, consumer, request)
+			var rangeErr *replayRangeError
+			if errors.As(err, &rangeErr) {
+				writeJSONError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err != nil {
+				writeJSONError(w, r, http.StatusBadGateway, fmt.Sprintf("Error replaying messages: %v", err))
+				return
+			}
+			writeJSON(w, r, http.StatusOK, result)
+		})
+	})
+}
+
+// fetchGroupStatus собирает смещения и участников consumer group через отдельный клиент,
+// чтобы не зависеть от состояния сессии consumer
+func fetchGroupStatus(cfg Config, config *sarama.Config) (*groupStatus, error) {
+	client, err := sarama.NewClient(cfg.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	// admin закрывает и клиент, повторный Close клиента вернет ошибку которую игнорируем
+	defer admin.Close()
+
+	offsets, err := admin.ListConsumerGroupOffsets(cfg.Group, nil)
+	if err != nil {
+		return nil, fmt.Errorf("listing group offsets: %w", err)
+	}
+
+	// партиции настроенных топиков плюс все, по которым у группы есть коммиты
+	partitions := make(map[string][]int32)
+	for topic, blocks := range offsets.Blocks {
+		for partition := range blocks {
+			partitions[topic] = append(partitions[topic], partition)
+		}
+	}
+	for _, topic := range cfg.Topics {
+		if _, ok := partitions[topic]; ok {
+			continue
+		}
+		topicPartitions, err := client.Partitions(topic)
+		if err != nil {
+			continue
+		}
+		partitions[topic] = topicPartitions
+	}
+
+	status := &groupStatus{Group: cfg.Group, Partitions: []partitionStatus{}, Members: []memberStatus{}}
+	for topic, topicPartitions := range partitions {
+		for _, partition := range topicPartitions {
+			hwm, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, fmt.Errorf("fetching high water mark for %s/%d: %w", topic, partition, err)
+			}
+			committed := int64(-1)
+			if block := offsets.GetBlock(topic, partition); block != nil {
+				committed = block.Offset
+			}
+			// без коммита группа начнет с самого старого сообщения, весь остаток партиции — lag
+			from := committed
+			if from < 0 {
+				if from, err = client.GetOffset(topic, partition, sarama.OffsetOldest); err != nil {
+					return nil, fmt.Errorf("fetching oldest offset for %s/%d: %w", topic, partition, err)
+				}
+			}
+			status.Partitions = append(status.Partitions, partitionStatus{
+				Topic:           topic,
+				Partition:       partition,
+				CommittedOffset: committed,
+				HighWaterMark:   hwm,
+				Lag:             max(hwm-from, 0),
+			})
+		}
+	}
+	slices.SortFunc(status.Partitions, func(a, b partitionStatus) int {
+		return cmp.Or(cmp.Compare(a.Topic, b.Topic), cmp.Compare(a.Partition, b.Partition))
+	})
+
+	groups, err := admin.DescribeConsumerGroups([]string{cfg.Group})
+	if err != nil {
+		return nil, fmt.Errorf("describing group: %w", err)
+	}
+	for _, group := range groups {
+		status.State = group.State
+		for memberID, member := range group.Members {
+			assignment, err := member.GetMemberAssignment()
+			if err != nil {
+				return nil, fmt.Errorf("decoding assignment of %s: %w", memberID, err)
+			}
+			assignments := map[string][]int32{}
+			if assignment != nil {
+				assignments = assignment.Topics
+			}
+			status.Members = append(status.Members, memberStatus{
+				MemberID:    memberID,
+				ClientID:    member.ClientId,
+				ClientHost:  member.ClientHost,
+				Assignments: assignments,
+			})
+		}
+	}
+	slices.SortFunc(status.Members, func(a, b memberStatus) int {
+		return cmp.Compare(a.MemberID, b.MemberID)
+	})
+	return status, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+var (
+	// очередь POST /facts?async=true заполнена, клиенту нужно повторить запрос позже
+	errAsyncQueueFull = errors.New("async queue is full")
+	// сервис останавливается и очередь уже дописана
+	errAsyncQueueClosed = errors.New("async queue is closed")
+)
+
+// asyncQueue принимает факты от POST /facts?async=true и отправляет их в kafka в фоне.
+// Клиент получает 202 до подтверждения от kafka, поэтому при падении процесса
+// факты из очереди теряются
+type asyncQueue struct {
+	producer sarama.SyncProducer
+	messages chan *sarama.ProducerMessage
+	done     chan struct{}
+
+	// время постановки сообщений, которые еще в очереди, в порядке очереди
+	mu       sync.Mutex
+	enqueued []time.Time
+	// после close канал messages закрыт и писать в него нельзя
+	closed bool
+}
+
+// asyncQueueStatus — состояние очереди для GET /admin/buffer
+type asyncQueueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+	// сколько ждет самое старое сообщение, 0 для пустой очереди
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+}
+
+// asyncFlushResult — результат POST /admin/buffer/flush
+type asyncFlushResult struct {
+	Produced int `json:"produced"`
+	Failed   int `json:"failed"`
+	asyncQueueStatus
+}
+
+func newAsyncQueue(producer sarama.SyncProducer, size int) *asyncQueue {
+	queue := &asyncQueue{
+		producer: producer,
+		messages: make(chan *sarama.ProducerMessage, size),
+		done:     make(chan struct{}),
+	}
+	go queue.run()
+	return queue
+}
+
+// enqueue ставит сообщение в очередь не блокируя запрос
+func (queue *asyncQueue) enqueue(msg *sarama.ProducerMessage) error {
+	// время записываем под той же блокировкой, чтобы порядок совпадал с порядком в канале
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.closed {
+		return errAsyncQueueClosed
+	}
+	select {
+	case queue.messages <- msg:
+		queue.enqueued = append(queue.enqueued, time.Now())
+		metrics.Gauge(metricAsyncQueueDepth, float64(len(queue.messages)))
+		return nil
+	default:
+		return errAsyncQueueFull
+	}
+}
+
+func (queue *asyncQueue) run() {
+	defer close(queue.done)
+	for msg := range queue.messages {
+		queue.send(msg)
+	}
+}
+
+// send отправляет сообщение взятое из очереди и возвращает false при ошибке
+func (queue *asyncQueue) send(msg *sarama.ProducerMessage) bool {
+	queue.mu.Lock()
+	if len(queue.enqueued) > 0 {
+		queue.enqueued = queue.enqueued[1:]
+	}
+	queue.mu.Unlock()
+	metrics.Gauge(metricAsyncQueueDepth, float64(len(queue.messages)))
+
+	if _, _, err := queue.producer.SendMessage(msg); err != nil {
+		metrics.Inc(metricAsyncProduceFailures)
+		log.Printf("Error producing async message: %v\n", err)
+		return false
+	}
+	return true
+}
+
+func (queue *asyncQueue) status() asyncQueueStatus {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	status := asyncQueueStatus{Depth: len(queue.messages), Capacity: cap(queue.messages)}
+	if len(queue.enqueued) > 0 {
+		status.OldestAgeSeconds = time.Since(queue.enqueued[0]).Seconds()
+	}
+	return status
+}
+
+// flush отправляет сообщения из очереди в текущей горутине параллельно с фоновой,
+// пока очередь не опустеет или не отменится ctx
+func (queue *asyncQueue) flush(ctx context.Context) asyncFlushResult {
+	var result asyncFlushResult
+	for ctx.Err() == nil {
+		msg, ok := queue.tryReceive()
+		if !ok {
+			break
+		}
+		if queue.send(msg) {
+			result.Produced++
+		} else {
+			result.Failed++
+		}
+	}
+	result.asyncQueueStatus = queue.status()
+	return result
+}
+
+// tryReceive берет сообщение из очереди не блокируясь
+func (queue *asyncQueue) tryReceive() (*sarama.ProducerMessage, bool) {
+	select {
+	case msg, ok := <-queue.messages:
+		return msg, ok
+	default:
+		return nil, false
+	}
+}
+
+// close дожидается отправки всех сообщений из очереди. Вызывается после остановки
+// HTTP сервера; обработчики, не уложившиеся в его остановку, получат errAsyncQueueClosed
+func (queue *asyncQueue) close() {
+	queue.mu.Lock()
+	queue.closed = true
+	close(queue.messages)
+	queue.mu.Unlock()
+	<-queue.done
+	log.Println("Async queue drained")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+// TestAsyncQueueEnqueueAfterClose ставит сообщения в очередь параллельно с ее закрытием:
+// опоздавшие получают errAsyncQueueClosed вместо паники, принятые записываются в kafka
+func TestAsyncQueueEnqueueAfterClose(t *testing.T) {
+	producer := &fakeProducer{}
+	queue := newAsyncQueue(producer, 1000)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := queue.enqueue(&sarama.ProducerMessage{Topic: "kek"})
+				if errors.Is(err, errAsyncQueueClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("enqueue: %v", err)
+					return
+				}
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	queue.close()
+	wg.Wait()
+
+	if err := queue.enqueue(&sarama.ProducerMessage{Topic: "kek"}); !errors.Is(err, errAsyncQueueClosed) {
+		t.Errorf("enqueue after close = %v, want %v", err, errAsyncQueueClosed)
+	}
+	if got := len(producer.sentTo("kek")); got != accepted {
+		t.Errorf("produced %d messages, want all %d accepted", got, accepted)
+	}
+}
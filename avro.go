@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Сообщения в формате Confluent: нулевой байт, id схемы в Schema Registry (4 байта big-endian)
+// и запись в бинарном Avro. Схема Message строится из полей структуры: string -> "string", int -> "long"
+
+// avroField — поле схемы Avro, соответствует полю Message
+type avroField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type avroSchema struct {
+	Type      string      `json:"type"`
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace,omitempty"`
+	Fields    []avroField `json:"fields"`
+}
+
+// messageAvroSchema возвращает схему Avro для Message
+func messageAvroSchema() avroSchema {
+	schema := avroSchema{Type: "record", Name: "Message", Namespace: "buffer"}
+	t := reflect.TypeOf(Message{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		avroType := "string"
+		if field.Type.Kind() == reflect.Int {
+			avroType = "long"
+		}
+		schema.Fields = append(schema.Fields, avroField{Name: messageFieldNames[field.Name], Type: avroType})
+	}
+	return schema
+}
+
+// avroCodec кодирует Message в Avro со схемой зарегистрированной в Schema Registry
+type avroCodec struct {
+	registry *schemaRegistry
+	schema   avroSchema
+	schemaID int
+
+	mu sync.Mutex
+	// id схем которыми можно читать сообщения: записаны теми же полями что и Message
+	compatible map[int]bool
+}
+
+// newAvroCodec регистрирует схему Message под subject. Если схема уже зарегистрирована,
+// Schema Registry вернет ее существующий id
+func newAvroCodec(registry *schemaRegistry, subject string) (*avroCodec, error) {
+	schema := messageAvroSchema()
+	spec, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	id, err := registry.register(ctx, subject, string(spec))
+	if err != nil {
+		return nil, err
+	}
+	return &avroCodec{registry: registry, schema: schema, schemaID: id, compatible: map[int]bool{id: true}}, nil
+}
+
+func (codec *avroCodec) Encode(message Message) ([]byte, error) {
+	buf := []byte{0}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(codec.schemaID))
+	v := reflect.ValueOf(message)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Int {
+			buf = binary.AppendVarint(buf, field.Int())
+			continue
+		}
+		buf = binary.AppendVarint(buf, int64(len(field.String())))
+		buf = append(buf, field.String()...)
+	}
+	return buf, nil
+}
+
+func (codec *avroCodec) Decode(value []byte) (Message, error) {
+	var message Message
+	if len(value) < 5 || value[0] != 0 {
+		return message, errors.New("missing schema registry header")
+	}
+	id := int(binary.BigEndian.Uint32(value[1:5]))
+	if err := codec.checkSchema(id); err != nil {
+		return message, err
+	}
+
+	reader := bytes.NewReader(value[5:])
+	v := reflect.ValueOf(&message).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		n, err := binary.ReadVarint(reader)
+		if err != nil {
+			return message, fmt.Errorf("reading field %s: %w", codec.schema.Fields[i].Name, err)
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Int {
+			field.SetInt(n)
+			continue
+		}
+		if n < 0 || n > int64(reader.Len()) {
+			return message, fmt.Errorf("reading field %s: invalid string length %d", codec.schema.Fields[i].Name, n)
+		}
+		text := make([]byte, n)
+		if _, err := io.ReadFull(reader, text); err != nil {
+			return message, fmt.Errorf("reading field %s: %w", codec.schema.Fields[i].Name, err)
+		}
+		field.SetString(string(text))
+	}
+	if reader.Len() > 0 {
+		return message, fmt.Errorf("%d trailing bytes after record", reader.Len())
+	}
+	return message, nil
+}
+
+// checkSchema проверяет что сообщение записано схемой с теми же полями что и Message.
+// Полноценного разрешения схем Avro нет, поэтому другие схемы не читаются
+func (codec *avroCodec) checkSchema(id int) error {
+	codec.mu.Lock()
+	defer codec.mu.Unlock()
+	if codec.compatible[id] {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	spec, err := codec.registry.schema(ctx, id)
+	if err != nil {
+		return fmt.Errorf("fetching schema %d: %w", id, err)
+	}
+	var writer avroSchema
+	if err := json.Unmarshal([]byte(spec), &writer); err != nil {
+		return fmt.Errorf("parsing schema %d: %w", id, err)
+	}
+	if writer.Type != "record" || !slices.Equal(writer.Fields, codec.schema.Fields) {
+		return fmt.Errorf("schema %d does not match Message fields", id)
+	}
+	codec.compatible[id] = true
+	return nil
+}
+
+// schemaRegistry — минимальный клиент REST API Confluent Schema Registry
+type schemaRegistry struct {
+	url    string
+	client *http.Client
+}
+
+func newSchemaRegistry(registryURL string) *schemaRegistry {
+	return &schemaRegistry{
+		url:    strings.TrimSuffix(registryURL, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// register регистрирует схему под subject и возвращает ее id
+func (registry *schemaRegistry) register(ctx context.Context, subject, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	var response struct {
+		ID int `json:"id"`
+	}
+	endpoint := registry.url + "/subjects/" + url.PathEscape(subject) + "/versions"
+	if err := registry.do(ctx, http.MethodPost, endpoint, body, &response); err != nil {
+		return 0, err
+	}
+	return response.ID, nil
+}
+
+// schema возвращает схему по id
+func (registry *schemaRegistry) schema(ctx context.Context, id int) (string, error) {
+	var response struct {
+		Schema string `json:"schema"`
+	}
+	endpoint := fmt.Sprintf("%s/schemas/ids/%d", registry.url, id)
+	if err := registry.do(ctx, http.MethodGet, endpoint, nil, &response); err != nil {
+		return "", err
+	}
+	return response.Schema, nil
+}
+
+func (registry *schemaRegistry) do(ctx context.Context, method, endpoint string, body []byte, response any) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+
+	resp, err := registry.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("schema registry responded with status %d, body %s", resp.StatusCode, responseBody)
+	}
+	return json.Unmarshal(responseBody, response)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// BatchSink доставляет несколько фактов одним запросом. Ошибка означает что пачка целиком
+// не подтверждена, и факты из нее будут отправлены по одному
+type BatchSink interface {
+	DeliverBatch(ctx context.Context, messages []Message) error
+}
+
+// consumeBatches копит разобранные факты партиции до BATCH_SIZE или BATCH_WINDOW и отправляет
+// их пачкой. Tombstone и нечитаемые сообщения обрабатываются по одному, перед ними накопленная
+// пачка отправляется, чтобы пометки шли в порядке смещений
+func (consumer *Consumer) consumeBatches(ctx context.Context, messages <-chan *sarama.ConsumerMessage, commits *offsetCommitter) error {
+	window := time.NewTicker(consumer.cfg.BatchWindow)
+	defer window.Stop()
+
+	var pending []*sarama.ConsumerMessage
+	var facts []Message
+	flush := func() {
+		if len(pending) > 0 {
+			consumer.deliverBatch(ctx, pending, facts, commits)
+			pending, facts = nil, nil
+		}
+	}
+
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				flush()
+				log.Printf("message channel was closed")
+				return nil
+			}
+			consumer.reconciliation.consumed(message)
+
+			if consumer.cfg.DeliverySemantics == deliveryAtMostOnce {
+				commits.mark(message)
+			}
+
+			fact, err := consumer.decode(message)
+			if message.Value == nil || err != nil {
+				flush()
+				if consumer.redeliver(ctx, message) && consumer.cfg.DeliverySemantics == deliveryAtLeastOnce {
+					commits.mark(message)
+				}
+				continue
+			}
+			pending = append(pending, message)
+			facts = append(facts, fact)
+			if len(pending) >= consumer.cfg.BatchSize {
+				flush()
+			}
+
+		case <-window.C:
+			flush()
+
+		case <-commits.tick():
+			commits.commit()
+
+		// непомеченная пачка будет прочитана заново следующей сессией
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// deliverBatch отправляет пачку и помечает все ее сообщения. Если пачка не принята,
+// факты отправляются по одному с обычными повторами и DLQ, каждое повторяется на месте,
+// пока не будет доставлено или не завершится сессия
+func (consumer *Consumer) deliverBatch(ctx context.Context, messages []*sarama.ConsumerMessage, facts []Message, commits *offsetCommitter) {
+	var result downstreamResult
+	err := consumer.batches.DeliverBatch(withDownstreamResult(ctx, &result), facts)
+	if err == nil {
+		log.Printf("sent batch of %d\n", len(facts))
+		for _, message := range messages {
+			consumer.observeResidence(message)
+			consumer.callbacks.notify(consumer, message, &result)
+			if consumer.cfg.DeliverySemantics == deliveryAtLeastOnce {
+				commits.mark(message)
+			}
+		}
+		return
+	}
+	// сессия завершается, пачка будет прочитана заново и не должна уйти на повтор
+	if ctx.Err() != nil {
+		return
+	}
+
+	consumer.deliveryErrors.Printf("Error delivering batch of %d, falling back to single delivery: %v\n", len(facts), err)
+	for _, message := range messages {
+		// остаток пачки после прерванного повтора будет прочитан заново
+		if !consumer.redeliver(ctx, message) {
+			return
+		}
+		if consumer.cfg.DeliverySemantics == deliveryAtLeastOnce {
+			commits.mark(message)
+		}
+	}
+}
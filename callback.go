@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	// заголовок POST /facts с адресом, на который отправить подтверждение доставки факта в API
+	callbackURLRequestHeader = "X-Callback-URL"
+	// заголовок сообщения kafka, в котором адрес подтверждения доходит до consumer
+	callbackURLHeaderKey = "callback-url"
+	// подтверждений отправляемых одновременно, сверх этого они пропускаются
+	maxCallbacksInFlight = 100
+	// сколько байт ответа API передается в подтверждении
+	maxCallbackResponseBody = 4 << 10
+)
+
+// checkCallbackURL разрешает только http(s) адреса на хостах из CALLBACK_ALLOWED_HOSTS,
+// иначе через заголовок можно было бы заставить consumer ходить по внутренним адресам
+func checkCallbackURL(cfg Config, callbackURL string) error {
+	if len(cfg.CallbackAllowedHosts) == 0 {
+		return errors.New("delivery callbacks are disabled")
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if !slices.Contains(cfg.CallbackAllowedHosts, strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("host %q is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// deliveryCallback — тело подтверждения доставки
+type deliveryCallback struct {
+	Status              string `json:"status"`
+	IndicatorToMoID     int    `json:"indicator_to_mo_id"`
+	IndicatorToMoFactID int    `json:"indicator_to_mo_fact_id"`
+	Topic               string `json:"topic"`
+	Partition           int32  `json:"partition"`
+	Offset              int64  `json:"offset"`
+	DeliveredAt         string `json:"delivered_at"`
+	// ответ API на доставку, нет у получателей без HTTP ответа
+	Downstream *downstreamResult `json:"downstream,omitempty"`
+}
+
+// downstreamResult — ответ API на доставку факта или пачки с ним
+type downstreamResult struct {
+	StatusCode int    `json:"status_code"`
+	Body       string `json:"body"`
+}
+
+type downstreamResultKey struct{}
+
+// withDownstreamResult возвращает контекст, в котором HTTPSink запишет ответ API в result
+func withDownstreamResult(ctx context.Context, result *downstreamResult) context.Context {
+	return context.WithValue(ctx, downstreamResultKey{}, result)
+}
+
+// recordDownstreamResult сохраняет ответ API, если контекст доставки его ждет
+func recordDownstreamResult(ctx context.Context, statusCode int, body []byte) {
+	result, ok := ctx.Value(downstreamResultKey{}).(*downstreamResult)
+	if !ok {
+		return
+	}
+	if len(body) > maxCallbackResponseBody {
+		body = body[:maxCallbackResponseBody]
+	}
+	result.StatusCode = statusCode
+	result.Body = string(body)
+}
+
+// callbackNotifier в фоне отправляет подтверждения доставки. Ошибки только логируются
+// и считаются в метрике: на пометку сообщения подтверждение не влияет
+type callbackNotifier struct {
+	client   *http.Client
+	inFlight chan struct{}
+}
+
+// newCallbackNotifier возвращает nil, если CALLBACK_ALLOWED_HOSTS не задан
+func newCallbackNotifier(cfg Config) *callbackNotifier {
+	if len(cfg.CallbackAllowedHosts) == 0 {
+		return nil
+	}
+	return &callbackNotifier{
+		client: &http.Client{
+			Timeout: cfg.CallbackTimeout,
+			// редирект увел бы запрос за пределы разрешенных хостов
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inFlight: make(chan struct{}, maxCallbacksInFlight),
+	}
+}
+
+// notify отправляет подтверждение для доставленного сообщения, если у него есть callback-url.
+// result — ответ API, пустой если получатель его не вернул
+func (n *callbackNotifier) notify(consumer *Consumer, message *sarama.ConsumerMessage, result *downstreamResult) {
+	if n == nil {
+		return
+	}
+	callbackURL, ok := callbackURLFrom(message)
+	if !ok {
+		return
+	}
+	// заголовок мог записать кто угодно с доступом к топику или сервис со старым
+	// CALLBACK_ALLOWED_HOSTS, поэтому адрес проверяется и перед отправкой
+	if err := checkCallbackURL(consumer.cfg, callbackURL); err != nil {
+		metrics.Inc(metricCallbackFailures)
+		log.Printf("Not calling back %q for message %s/%d/%d: %v\n", callbackURL, message.Topic, message.Partition, message.Offset, err)
+		return
+	}
+	fact, err := consumer.decode(message)
+	if err != nil {
+		return
+	}
+	body := deliveryCallback{
+		Status:              "delivered",
+		IndicatorToMoID:     fact.IndicatorToMoID,
+		IndicatorToMoFactID: fact.IndicatorToMoFactID,
+		Topic:               message.Topic,
+		Partition:           message.Partition,
+		Offset:              message.Offset,
+		DeliveredAt:         time.Now().UTC().Format(time.RFC3339),
+	}
+	if result != nil && result.StatusCode != 0 {
+		body.Downstream = result
+	}
+
+	select {
+	case n.inFlight <- struct{}{}:
+		go func() {
+			defer func() { <-n.inFlight }()
+			if err := n.send(callbackURL, body); err != nil {
+				metrics.Inc(metricCallbackFailures)
+				log.Printf("Error calling back %s for message %s/%d/%d: %v\n", callbackURL, message.Topic, message.Partition, message.Offset, err)
+			}
+		}()
+	default:
+		metrics.Inc(metricCallbackFailures)
+		log.Printf("Too many callbacks in flight, skipping message %s/%d/%d\n", message.Topic, message.Partition, message.Offset)
+	}
+}
+
+func (n *callbackNotifier) send(callbackURL string, callback deliveryCallback) error {
+	body, err := json.Marshal(callback)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func callbackURLFrom(message *sarama.ConsumerMessage) (string, bool) {
+	for _, header := range message.Headers {
+		if string(header.Key) == callbackURLHeaderKey {
+			return string(header.Value), len(header.Value) > 0
+		}
+	}
+	return "", false
+}
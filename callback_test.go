@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// TestCallbackCarriesDownstreamResult проверяет, что подтверждение содержит ответ API, а адрес
+// с неразрешенного хоста проверяется еще раз перед отправкой и не вызывается
+func TestCallbackCarriesDownstreamResult(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"STATUS":"OK","id":17}`))
+	}))
+	defer downstream.Close()
+
+	callbacks := make(chan deliveryCallback, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var callback deliveryCallback
+		if err := json.NewDecoder(r.Body).Decode(&callback); err != nil {
+			t.Errorf("decoding callback: %v", err)
+		}
+		callbacks <- callback
+	}))
+	defer receiver.Close()
+
+	cfg := testConfig(t)
+	cfg.CallbackAllowedHosts = []string{"127.0.0.1"}
+	consumer := newTestConsumer(cfg, NewHTTPSink(downstream.URL, http.MethodPost, ""), &fakeProducer{})
+	consumer.callbacks = newCallbackNotifier(cfg)
+
+	// тот же получатель по имени localhost, которого нет в CALLBACK_ALLOWED_HOSTS
+	receiverURL, err := url.Parse(receiver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disallowed := "http://localhost:" + receiverURL.Port()
+
+	withCallback := func(message *sarama.ConsumerMessage, callbackURL string) *sarama.ConsumerMessage {
+		message.Headers = append(message.Headers, &sarama.RecordHeader{Key: []byte(callbackURLHeaderKey), Value: []byte(callbackURL)})
+		return message
+	}
+	consumeAll(t, consumer, &fakeMarker{},
+		withCallback(testFactMessage(t, 0, 7), disallowed),
+		withCallback(testFactMessage(t, 1, 7), receiver.URL),
+	)
+
+	select {
+	case callback := <-callbacks:
+		if callback.Offset != 1 {
+			t.Errorf("callback offset = %d, want 1", callback.Offset)
+		}
+		want := downstreamResult{StatusCode: http.StatusOK, Body: `{"STATUS":"OK","id":17}`}
+		if callback.Downstream == nil || *callback.Downstream != want {
+			t.Errorf("downstream = %+v, want %+v", callback.Downstream, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback was not sent")
+	}
+	select {
+	case callback := <-callbacks:
+		t.Errorf("unexpected callback for offset %d", callback.Offset)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec сериализует Message в значение сообщения kafka и обратно, выбирается через SERIALIZATION
+type Codec interface {
+	Encode(message Message) ([]byte, error)
+	Decode(value []byte) (Message, error)
+}
+
+// newCodec возвращает Codec выбранный через SERIALIZATION
+func newCodec(cfg Config) (Codec, error) {
+	switch cfg.Serialization {
+	case "avro":
+		registry := newSchemaRegistry(cfg.SchemaRegistryURL)
+		subject := cfg.SchemaRegistrySubject
+		if subject == "" {
+			subject = cfg.ProduceTopic() + "-value"
+		}
+		codec, err := newAvroCodec(registry, subject)
+		if err != nil {
+			return nil, fmt.Errorf("registering schema for subject %s: %w", subject, err)
+		}
+		return codec, nil
+	default:
+		return jsonCodec{}, nil
+	}
+}
+
+// jsonCodec — сообщение в json, формат по умолчанию
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(message Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Decode(value []byte) (Message, error) {
+	var message Message
+	err := json.Unmarshal(value, &message)
+	return message, err
+}
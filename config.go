@@ -0,0 +1,853 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	// сообщение помечается только после успешной отправки в API: при сбое оно будет прочитано
+	// повторно, возможны дубли в API, но факт не теряется
+	deliveryAtLeastOnce = "at-least-once"
+	// сообщение помечается сразу после чтения, до отправки: дублей нет и сбои API не задерживают
+	// очередь, но при ошибке отправки или падении процесса факт теряется
+	deliveryAtMostOnce = "at-most-once"
+)
+
+// Config — все настройки сервиса. Заполняется из переменных окружения в LoadConfig
+// и передается компонентам явно
+type Config struct {
+	// адреса брокеров kafka
+	Brokers      []string
+	KafkaVersion sarama.KafkaVersion
+	// KAFKA_VERSION=auto: версия определяется по брокерам при старте
+	KafkaVersionAuto bool
+	Group            string
+	// топики для чтения, факты пишутся в первый из них
+	Topics []string
+	// если задан, consumer подписывается на все топики подходящие под шаблон вместо Topics
+	TopicPattern *regexp.Regexp
+	// как часто перечитывать список топиков для TopicPattern
+	TopicRefreshInterval time.Duration
+	// если задан, партиции единственного топика читаются напрямую, без consumer group
+	ConsumePartitions []int32
+	// что делать если топик для чтения не существует при старте: warn или fail
+	MissingTopicsPolicy string
+	// максимальный размер сообщения в kafka, должен быть не больше message.max.bytes брокера
+	MaxMessageBytes int
+	// как producer выбирает партицию: hash, random, roundrobin или manual
+	Partitioner string
+	// настройки накопления сообщений producer перед отправкой брокеру, 0 - отправлять сразу
+	FlushFrequency   time.Duration
+	FlushMessages    int
+	FlushBytes       int
+	FlushMaxMessages int
+	// размеры fetch запросов consumer в байтах и размер буфера сообщений на партицию
+	FetchMinBytes     int32
+	FetchDefaultBytes int32
+	FetchMaxBytes     int32
+	ChannelBufferSize int
+	// сколько раз пытаться подключить consumer group, 0 - без ограничения
+	ConsumerMaxAttempts int
+	// таймаут сессии consumer group и частота heartbeat, см. "Таймауты consumer group" в readme
+	SessionTimeout    time.Duration
+	HeartbeatInterval time.Duration
+	// сколько брокер ждет участников при ребалансировке
+	RebalanceTimeout time.Duration
+	// параллельных обработчиков на партицию, сообщения с одним ключом обрабатываются по порядку
+	ConsumerWorkers int
+	// коммитить смещения каждые CommitBatchSize пометок или раз в CommitInterval,
+	// 0 - коммиты делает sarama раз в CommitInterval
+	CommitBatchSize int
+	CommitInterval  time.Duration
+	// после стольких неудачных доставок сообщение уходит в DeadLetterTopic, 0 - повторы отключены
+	MaxDeliveryAttempts int
+	// куда переписывается недоставленное сообщение, пусто - в его же топик
+	RetryTopic string
+	// пауза перед повтором, удваивается с каждой попыткой до RetryBackoffMax, 0 - без паузы
+	RetryBackoff    time.Duration
+	RetryBackoffMax time.Duration
+	// топик для сообщений которые не удалось доставить
+	DeadLetterTopic string
+	// создавать RetryTopic и DeadLetterTopic при старте, если их нет
+	CreateTopics            bool
+	CreateTopicsPartitions  int32
+	CreateTopicsReplication int16
+	// писать в лог время нахождения каждого доставленного сообщения в буфере
+	LogResidenceTime bool
+	// не чаще раза в интервал писать ошибки доставки в API, 0 - писать каждую
+	ErrorLogInterval time.Duration
+	// сколько ждать штатной остановки после SIGTERM или падения компонента, потом os.Exit, 0 - ждать сколько угодно
+	ShutdownTimeout time.Duration
+	// как часто писать в лог сверку прочитанных и помеченных сообщений, 0 - не писать
+	ReconcileLogInterval time.Duration
+
+	// префикс для всех HTTP маршрутов, если сервис стоит за ingress который не срезает путь
+	RoutePrefix string
+	// таймауты HTTP сервера, защищают от медленных клиентов держащих соединение
+	HTTPReadTimeout    time.Duration
+	HTTPWriteTimeout   time.Duration
+	HTTPIdleTimeout    time.Duration
+	HTTPHandlerTimeout time.Duration
+	// запросы дольше порога пишутся в лог с предупреждением, 0 - не писать
+	SlowRequestThreshold time.Duration
+	// если задан, /metrics требует заголовок Authorization: Bearer <token>
+	MetricsAuthToken string
+	// система метрик: prometheus, statsd или none
+	MetricsBackend string
+	StatsdAddr     string
+	StatsdPrefix   string
+	// токен для /admin, без него служебные эндпоинты отключены
+	AdminAuthToken string
+	// сколько POST /facts и DELETE /facts ждут подтверждения от kafka, 0 - без ограничения
+	ProduceTimeout time.Duration
+	// размер очереди POST /facts?async=true
+	AsyncQueueSize int
+	// сколько байт multipart формы POST /facts держать в памяти, остальное пишется во временные файлы
+	MultipartMemoryLimit int64
+	// отклонять POST /facts в котором поле передано несколько раз
+	StrictFormFields bool
+	// принимать в POST /facts имена полей в camelCase наравне с snake_case
+	AcceptCamelCase bool
+	// допустимые значения period_key, пустой список отключает проверку
+	PeriodKeys []string
+	// писать в лог разобранный факт каждого POST /facts, поля из DebugRedactFields скрываются
+	DebugLogBodies    bool
+	DebugRedactFields []string
+	// максимальный диапазон сообщений для POST /admin/replay
+	ReplayMaxMessages int
+
+	// формат значения сообщений в kafka: json или avro через Schema Registry
+	Serialization         string
+	SchemaRegistryURL     string
+	SchemaRegistrySubject string
+
+	// порядок пометки сообщения относительно отправки в API, см. deliveryAtLeastOnce и deliveryAtMostOnce
+	DeliverySemantics string
+	// преобразование сообщения перед отправкой в API, см. newTransform
+	MessageTransform    string
+	MessageStaticFields string
+	// получатель сообщений из kafka: http или noop
+	Sink string
+	// адрес, метод и токен API куда отправляются факты
+	TargetURL    string
+	TargetMethod string
+	TargetToken  string
+	// OAuth2 client credentials вместо статического TargetToken, включается TargetOAuthTokenURL
+	TargetOAuthTokenURL     string
+	TargetOAuthClientID     string
+	TargetOAuthClientSecret string
+	TargetOAuthScopes       []string
+	// адрес API пакетного сохранения, используется при BatchSize > 0
+	TargetBatchURL string
+	// сколько фактов отправлять одним запросом и сколько максимум ждать набора пачки, 0 - по одному
+	BatchSize   int
+	BatchWindow time.Duration
+	// хосты, на которые разрешены подтверждения доставки из X-Callback-URL, пусто - отключены
+	CallbackAllowedHosts []string
+	CallbackTimeout      time.Duration
+	// второй API, в который факты дублируются без влияния на пометку, например при миграции
+	TargetMirrorURL string
+	// bearer токен зеркала, авторизация основного API в зеркало не отправляется
+	TargetMirrorToken string
+	// адрес API удаления факта, пусто - DELETE /facts отключен
+	TargetDeleteURL string
+	// таймауты запросов в API: установка соединения, ожидание заголовков ответа и запрос целиком
+	TargetConnectTimeout        time.Duration
+	TargetResponseHeaderTimeout time.Duration
+	TargetTotalTimeout          time.Duration
+	// прокси для запросов в API; если не задан, используются HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+	TargetProxyURL *url.URL
+	// не передавать в API indicator_to_mo_fact_id равный 0
+	TargetOmitZeroFactID bool
+	// переименование полей формы для API, по умолчанию ключи совпадают с именами полей
+	TargetFieldMapping map[string]string
+	// коды ответа API которые считаются успешной доставкой
+	SuccessStatusCodes []int
+	// коды ответа API после которых доставку стоит повторить, с остальными сообщение сразу уходит в DLQ
+	RetryableStatusCodes []int
+	// поле json ответа и его значение при успешной доставке, пустое поле отключает проверку тела
+	SuccessField string
+	SuccessValue string
+	// пути к клиентскому сертификату и ключу для mTLS и к CA для проверки сертификата API
+	TargetClientCert string
+	TargetClientKey  string
+	TargetCACert     string
+}
+
+// LoadConfig читает настройки из переменных окружения и проверяет их.
+// Возвращает все найденные ошибки сразу, чтобы не исправлять конфигурацию по одной
+func LoadConfig() (Config, error) {
+	env := &envReader{}
+	cfg := Config{
+		Brokers:              env.list("KAFKA_BROKERS", "kafka:9092"),
+		KafkaVersion:         env.kafkaVersion("KAFKA_VERSION", sarama.DefaultVersion),
+		KafkaVersionAuto:     strings.EqualFold(env.string("KAFKA_VERSION", ""), "auto"),
+		Group:                env.string("KAFKA_GROUP", "mygroup"),
+		Topics:               env.list("KAFKA_TOPICS", "kek"),
+		TopicPattern:         env.regexp("KAFKA_TOPIC_PATTERN"),
+		TopicRefreshInterval: env.duration("KAFKA_TOPIC_REFRESH_INTERVAL", time.Minute),
+		ConsumePartitions:    env.partitions("CONSUME_PARTITIONS"),
+		MissingTopicsPolicy:  env.oneOf("KAFKA_MISSING_TOPICS", "warn", "warn", "fail"),
+		MaxMessageBytes:      env.int("KAFKA_MAX_MESSAGE_BYTES", sarama.NewConfig().Producer.MaxMessageBytes),
+		Partitioner:          env.oneOf("KAFKA_PARTITIONER", "hash", "hash", "random", "roundrobin", "manual"),
+		FlushFrequency:       env.duration("KAFKA_FLUSH_FREQUENCY", 0),
+		FlushMessages:        env.int("KAFKA_FLUSH_MESSAGES", 0),
+		FlushBytes:           env.int("KAFKA_FLUSH_BYTES", 0),
+		FlushMaxMessages:     env.int("KAFKA_FLUSH_MAX_MESSAGES", 0),
+		FetchMinBytes:        int32(env.int("KAFKA_FETCH_MIN_BYTES", 1)),
+		FetchDefaultBytes:    int32(env.int("KAFKA_FETCH_DEFAULT_BYTES", 1024*1024)),
+		FetchMaxBytes:        int32(env.int("KAFKA_FETCH_MAX_BYTES", 0)),
+		ChannelBufferSize:    env.int("KAFKA_CHANNEL_BUFFER_SIZE", 256),
+		ConsumerMaxAttempts:  env.int("CONSUMER_MAX_ATTEMPTS", 0),
+		ConsumerWorkers:      env.int("CONSUMER_WORKERS", 1),
+		SessionTimeout:       env.duration("KAFKA_SESSION_TIMEOUT", 10*time.Second),
+		HeartbeatInterval:    env.duration("KAFKA_HEARTBEAT_INTERVAL", 3*time.Second),
+		RebalanceTimeout:     env.duration("KAFKA_REBALANCE_TIMEOUT", 60*time.Second),
+		CommitBatchSize:      env.int("COMMIT_BATCH_SIZE", 0),
+		CommitInterval:       env.duration("COMMIT_INTERVAL", time.Second),
+		LogResidenceTime:     env.bool("LOG_RESIDENCE_TIME", false),
+		ErrorLogInterval:     env.duration("ERROR_LOG_INTERVAL", 0),
+		ReconcileLogInterval: env.duration("RECONCILE_LOG_INTERVAL", time.Minute),
+		ShutdownTimeout:      env.duration("SHUTDOWN_TIMEOUT", 40*time.Second),
+		MaxDeliveryAttempts:  env.int("MAX_DELIVERY_ATTEMPTS", 0),
+		RetryTopic:           env.string("KAFKA_RETRY_TOPIC", ""),
+		RetryBackoff:         env.duration("RETRY_BACKOFF", time.Second),
+		RetryBackoffMax:      env.duration("RETRY_BACKOFF_MAX", time.Minute),
+		DeadLetterTopic:      env.string("KAFKA_DLQ_TOPIC", ""),
+
+		CreateTopics:            env.bool("KAFKA_CREATE_TOPICS", false),
+		CreateTopicsPartitions:  int32(env.int("KAFKA_CREATE_TOPICS_PARTITIONS", 1)),
+		CreateTopicsReplication: int16(env.int("KAFKA_CREATE_TOPICS_REPLICATION", 1)),
+
+		RoutePrefix:        normalizeRoutePrefix(env.string("HTTP_ROUTE_PREFIX", "")),
+		HTTPReadTimeout:    env.duration("HTTP_READ_TIMEOUT", 15*time.Second),
+		HTTPWriteTimeout:   env.duration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		HTTPIdleTimeout:    env.duration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+		HTTPHandlerTimeout: env.duration("HTTP_HANDLER_TIMEOUT", 25*time.Second),
+
+		SlowRequestThreshold: env.duration("SLOW_REQUEST_THRESHOLD", time.Second),
+		MetricsAuthToken:     env.string("METRICS_AUTH_TOKEN", ""),
+		AdminAuthToken:       env.string("ADMIN_AUTH_TOKEN", ""),
+		MetricsBackend:       env.oneOf("METRICS_BACKEND", "prometheus", "prometheus", "statsd", "none"),
+		StatsdAddr:           env.string("STATSD_ADDR", "localhost:8125"),
+		StatsdPrefix:         env.string("STATSD_PREFIX", ""),
+		ReplayMaxMessages:    env.int("REPLAY_MAX_MESSAGES", 1000),
+		ProduceTimeout:       env.duration("PRODUCE_TIMEOUT", 10*time.Second),
+		AsyncQueueSize:       env.int("ASYNC_QUEUE_SIZE", 1000),
+		MultipartMemoryLimit: int64(env.int("MULTIPART_MEMORY_LIMIT", 10<<20)),
+		StrictFormFields:     env.bool("STRICT_FORM_FIELDS", false),
+		AcceptCamelCase:      env.bool("ACCEPT_CAMEL_CASE", false),
+		PeriodKeys:           env.list("PERIOD_KEYS", "day,month,quarter,year"),
+		DebugLogBodies:       env.bool("DEBUG_LOG_BODIES", false),
+		DebugRedactFields:    env.list("DEBUG_REDACT_FIELDS", "comment,auth_user_id"),
+
+		DeliverySemantics:     env.oneOf("DELIVERY_SEMANTICS", deliveryAtLeastOnce, deliveryAtLeastOnce, deliveryAtMostOnce),
+		Serialization:         env.oneOf("SERIALIZATION", "json", "json", "avro"),
+		SchemaRegistryURL:     env.string("SCHEMA_REGISTRY_URL", ""),
+		SchemaRegistrySubject: env.string("SCHEMA_REGISTRY_SUBJECT", ""),
+
+		MessageTransform:    env.oneOf("MESSAGE_TRANSFORM", "identity", "identity", "static"),
+		MessageStaticFields: env.string("MESSAGE_STATIC_FIELDS", ""),
+		Sink:                env.oneOf("SINK", "http", "http", "noop"),
+		TargetURL:           env.string("TARGET_URL", "https://development.kpi-drive.ru/_api/facts/save_fact"),
+		// факт передается в теле формы, поэтому допустимы только методы с телом
+		TargetMethod: env.oneOf("TARGET_HTTP_METHOD", http.MethodPost, http.MethodPost, http.MethodPut, http.MethodPatch),
+		TargetToken:  env.string("TARGET_TOKEN", "48ab34464a5573519725deb5865cc74c"),
+
+		TargetOAuthTokenURL:     env.string("TARGET_OAUTH_TOKEN_URL", ""),
+		TargetOAuthClientID:     env.string("TARGET_OAUTH_CLIENT_ID", ""),
+		TargetOAuthClientSecret: env.string("TARGET_OAUTH_CLIENT_SECRET", ""),
+		TargetOAuthScopes:       env.list("TARGET_OAUTH_SCOPES", ""),
+
+		TargetDeleteURL:   env.string("TARGET_DELETE_URL", ""),
+		TargetMirrorURL:   env.string("TARGET_MIRROR_URL", ""),
+		TargetMirrorToken: env.string("TARGET_MIRROR_TOKEN", ""),
+		TargetBatchURL:    env.string("TARGET_BATCH_URL", ""),
+
+		TargetOmitZeroFactID: env.bool("TARGET_OMIT_ZERO_FACT_ID", false),
+		CallbackAllowedHosts: env.list("CALLBACK_ALLOWED_HOSTS", ""),
+		CallbackTimeout:      env.duration("CALLBACK_TIMEOUT", 5*time.Second),
+		BatchSize:            env.int("BATCH_SIZE", 0),
+		BatchWindow:          env.duration("BATCH_WINDOW", time.Second),
+		TargetProxyURL:       env.proxyURL("TARGET_PROXY_URL"),
+
+		TargetConnectTimeout:        env.duration("TARGET_CONNECT_TIMEOUT", 30*time.Second),
+		TargetResponseHeaderTimeout: env.duration("TARGET_RESPONSE_HEADER_TIMEOUT", 0),
+		TargetTotalTimeout:          env.duration("TARGET_TOTAL_TIMEOUT", 10*time.Second),
+
+		SuccessStatusCodes:   env.intList("SUCCESS_STATUS_CODES", "200"),
+		RetryableStatusCodes: env.intList("RETRYABLE_STATUS_CODES", "408,425,429,500,502,503,504"),
+		SuccessField:         env.string("TARGET_SUCCESS_FIELD", "STATUS"),
+		SuccessValue:         env.string("TARGET_SUCCESS_VALUE", "OK"),
+
+		TargetClientCert: env.string("TARGET_CLIENT_CERT", ""),
+		TargetClientKey:  env.string("TARGET_CLIENT_KEY", ""),
+		TargetCACert:     env.string("TARGET_CA_CERT", ""),
+	}
+
+	mapping, err := parseFieldMapping(env.string("TARGET_FIELD_MAPPING", ""))
+	if err != nil {
+		env.fail("TARGET_FIELD_MAPPING", err)
+	}
+	cfg.TargetFieldMapping = mapping
+	if _, err := newTransform(cfg.MessageTransform, cfg.MessageStaticFields); err != nil {
+		env.fail("MESSAGE_STATIC_FIELDS", err)
+	}
+
+	if len(cfg.Brokers) == 0 {
+		env.fail("KAFKA_BROKERS", errors.New("at least one broker is required"))
+	}
+	if cfg.Group == "" {
+		env.fail("KAFKA_GROUP", errors.New("required"))
+	}
+	if len(cfg.Topics) == 0 {
+		env.fail("KAFKA_TOPICS", errors.New("at least one topic is required"))
+	}
+	if cfg.MaxMessageBytes <= 0 {
+		env.fail("KAFKA_MAX_MESSAGE_BYTES", errors.New("must be positive"))
+	}
+	if cfg.MultipartMemoryLimit <= 0 {
+		env.fail("MULTIPART_MEMORY_LIMIT", errors.New("must be positive"))
+	}
+	if cfg.FlushFrequency < 0 {
+		env.fail("KAFKA_FLUSH_FREQUENCY", errors.New("must not be negative"))
+	}
+	if cfg.FlushMessages < 0 {
+		env.fail("KAFKA_FLUSH_MESSAGES", errors.New("must not be negative"))
+	}
+	if cfg.FlushBytes < 0 {
+		env.fail("KAFKA_FLUSH_BYTES", errors.New("must not be negative"))
+	}
+	if cfg.FlushMaxMessages < 0 {
+		env.fail("KAFKA_FLUSH_MAX_MESSAGES", errors.New("must not be negative"))
+	} else if cfg.FlushMaxMessages > 0 && cfg.FlushMaxMessages < cfg.FlushMessages {
+		env.fail("KAFKA_FLUSH_MAX_MESSAGES", errors.New("must not be less than KAFKA_FLUSH_MESSAGES"))
+	}
+	if len(cfg.ConsumePartitions) > 0 && cfg.TopicPattern != nil {
+		env.fail("CONSUME_PARTITIONS", errors.New("cannot be combined with KAFKA_TOPIC_PATTERN"))
+	}
+	if len(cfg.ConsumePartitions) > 0 && len(cfg.Topics) != 1 {
+		env.fail("CONSUME_PARTITIONS", errors.New("requires exactly one topic in KAFKA_TOPICS"))
+	}
+	if cfg.FetchMinBytes <= 0 {
+		env.fail("KAFKA_FETCH_MIN_BYTES", errors.New("must be positive"))
+	}
+	if cfg.FetchDefaultBytes <= 0 {
+		env.fail("KAFKA_FETCH_DEFAULT_BYTES", errors.New("must be positive"))
+	}
+	if cfg.FetchMaxBytes < 0 {
+		env.fail("KAFKA_FETCH_MAX_BYTES", errors.New("must not be negative"))
+	} else if cfg.FetchMaxBytes > 0 && cfg.FetchMaxBytes < cfg.FetchDefaultBytes {
+		env.fail("KAFKA_FETCH_MAX_BYTES", errors.New("must not be less than KAFKA_FETCH_DEFAULT_BYTES"))
+	}
+	if cfg.ChannelBufferSize < 0 {
+		env.fail("KAFKA_CHANNEL_BUFFER_SIZE", errors.New("must not be negative"))
+	}
+	if cfg.ConsumerMaxAttempts < 0 {
+		env.fail("CONSUMER_MAX_ATTEMPTS", errors.New("must not be negative"))
+	}
+	if cfg.SessionTimeout <= 0 {
+		env.fail("KAFKA_SESSION_TIMEOUT", errors.New("must be positive"))
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		env.fail("KAFKA_HEARTBEAT_INTERVAL", errors.New("must be positive"))
+	} else if cfg.HeartbeatInterval >= cfg.SessionTimeout {
+		env.fail("KAFKA_HEARTBEAT_INTERVAL", errors.New("must be less than KAFKA_SESSION_TIMEOUT"))
+	}
+	if cfg.RebalanceTimeout <= 0 {
+		env.fail("KAFKA_REBALANCE_TIMEOUT", errors.New("must be positive"))
+	}
+	if cfg.ConsumerWorkers < 1 {
+		env.fail("CONSUMER_WORKERS", errors.New("must be at least 1"))
+	}
+	if cfg.ShutdownTimeout < 0 {
+		env.fail("SHUTDOWN_TIMEOUT", errors.New("must not be negative"))
+	}
+	if cfg.ReconcileLogInterval < 0 {
+		env.fail("RECONCILE_LOG_INTERVAL", errors.New("must not be negative"))
+	}
+	if cfg.CommitBatchSize < 0 {
+		env.fail("COMMIT_BATCH_SIZE", errors.New("must not be negative"))
+	}
+	if cfg.MaxDeliveryAttempts < 0 {
+		env.fail("MAX_DELIVERY_ATTEMPTS", errors.New("must not be negative"))
+	}
+	if cfg.CreateTopicsPartitions <= 0 {
+		env.fail("KAFKA_CREATE_TOPICS_PARTITIONS", errors.New("must be positive"))
+	}
+	if cfg.CreateTopicsReplication <= 0 {
+		env.fail("KAFKA_CREATE_TOPICS_REPLICATION", errors.New("must be positive"))
+	}
+	if cfg.MaxDeliveryAttempts > 0 && cfg.DeadLetterTopic == "" {
+		env.fail("KAFKA_DLQ_TOPIC", errors.New("required when MAX_DELIVERY_ATTEMPTS is set"))
+	}
+	// сообщения из непрочитываемого топика повтора никогда не были бы доставлены
+	if cfg.RetryTopic != "" {
+		switch {
+		case cfg.TopicPattern != nil && !cfg.TopicPattern.MatchString(cfg.RetryTopic):
+			env.fail("KAFKA_RETRY_TOPIC", errors.New("must match KAFKA_TOPIC_PATTERN"))
+		case cfg.TopicPattern == nil && !slices.Contains(cfg.Topics, cfg.RetryTopic):
+			env.fail("KAFKA_RETRY_TOPIC", errors.New("must be one of KAFKA_TOPICS"))
+		}
+	}
+	// группа, читающая свой DLQ, снова отправляла бы мертвые сообщения в API
+	if cfg.DeadLetterTopic != "" {
+		switch {
+		case cfg.TopicPattern != nil && cfg.TopicPattern.MatchString(cfg.DeadLetterTopic):
+			env.fail("KAFKA_DLQ_TOPIC", errors.New("must not match KAFKA_TOPIC_PATTERN"))
+		case cfg.TopicPattern == nil && slices.Contains(cfg.Topics, cfg.DeadLetterTopic):
+			env.fail("KAFKA_DLQ_TOPIC", errors.New("must not be one of KAFKA_TOPICS"))
+		}
+	}
+	if cfg.CommitInterval <= 0 {
+		env.fail("COMMIT_INTERVAL", errors.New("must be positive"))
+	}
+	if cfg.TopicRefreshInterval <= 0 {
+		env.fail("KAFKA_TOPIC_REFRESH_INTERVAL", errors.New("must be positive"))
+	}
+	if (cfg.TargetClientCert == "") != (cfg.TargetClientKey == "") {
+		env.fail("TARGET_CLIENT_CERT", errors.New("TARGET_CLIENT_CERT and TARGET_CLIENT_KEY must be set together"))
+	} else if _, err := newTargetTLSConfig(cfg); err != nil {
+		env.fail("TARGET_CLIENT_CERT", err)
+	}
+	if len(cfg.SuccessStatusCodes) == 0 {
+		env.fail("SUCCESS_STATUS_CODES", errors.New("at least one status code is required"))
+	}
+	for _, code := range cfg.SuccessStatusCodes {
+		if code < 100 || code > 599 {
+			env.fail("SUCCESS_STATUS_CODES", fmt.Errorf("invalid HTTP status code %d", code))
+		}
+	}
+	for _, code := range cfg.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			env.fail("RETRYABLE_STATUS_CODES", fmt.Errorf("invalid HTTP status code %d", code))
+		} else if slices.Contains(cfg.SuccessStatusCodes, code) {
+			env.fail("RETRYABLE_STATUS_CODES", fmt.Errorf("status code %d is also in SUCCESS_STATUS_CODES", code))
+		}
+	}
+	if cfg.RetryBackoff < 0 {
+		env.fail("RETRY_BACKOFF", errors.New("must not be negative"))
+	}
+	if cfg.RetryBackoff > 0 && cfg.RetryBackoffMax < cfg.RetryBackoff {
+		env.fail("RETRY_BACKOFF_MAX", errors.New("must not be less than RETRY_BACKOFF"))
+	}
+	if cfg.MetricsBackend == "statsd" && cfg.StatsdAddr == "" {
+		env.fail("STATSD_ADDR", errors.New("required with METRICS_BACKEND=statsd"))
+	}
+	if cfg.SlowRequestThreshold < 0 {
+		env.fail("SLOW_REQUEST_THRESHOLD", errors.New("must not be negative"))
+	}
+	if cfg.ProduceTimeout < 0 {
+		env.fail("PRODUCE_TIMEOUT", errors.New("must not be negative"))
+	}
+	// 0 в http.Server отключает таймаут, а не делает его мгновенным
+	if cfg.HTTPReadTimeout <= 0 {
+		env.fail("HTTP_READ_TIMEOUT", errors.New("must be positive"))
+	}
+	if cfg.HTTPWriteTimeout <= 0 {
+		env.fail("HTTP_WRITE_TIMEOUT", errors.New("must be positive"))
+	}
+	if cfg.HTTPIdleTimeout <= 0 {
+		env.fail("HTTP_IDLE_TIMEOUT", errors.New("must be positive"))
+	}
+	// иначе соединение закрывается раньше, чем клиент получит 504 обработчика или kafka
+	if cfg.HTTPHandlerTimeout <= 0 {
+		env.fail("HTTP_HANDLER_TIMEOUT", errors.New("must be positive"))
+	} else if cfg.HTTPHandlerTimeout >= cfg.HTTPWriteTimeout {
+		env.fail("HTTP_HANDLER_TIMEOUT", errors.New("must be less than HTTP_WRITE_TIMEOUT"))
+	}
+	if cfg.ProduceTimeout > 0 && cfg.ProduceTimeout >= cfg.HTTPHandlerTimeout {
+		env.fail("PRODUCE_TIMEOUT", errors.New("must be less than HTTP_HANDLER_TIMEOUT"))
+	}
+	// HTTP сервер при остановке дожидается текущих запросов до HTTP_HANDLER_TIMEOUT,
+	// принудительный выход раньше оборвал бы их
+	if cfg.ShutdownTimeout > 0 && cfg.ShutdownTimeout <= cfg.HTTPHandlerTimeout {
+		env.fail("SHUTDOWN_TIMEOUT", errors.New("must be greater than HTTP_HANDLER_TIMEOUT"))
+	}
+	for _, field := range cfg.DebugRedactFields {
+		if !isMessageField(field) {
+			env.fail("DEBUG_REDACT_FIELDS", fmt.Errorf("unknown field %q", field))
+		}
+	}
+	if cfg.AsyncQueueSize <= 0 {
+		env.fail("ASYNC_QUEUE_SIZE", errors.New("must be positive"))
+	}
+	if cfg.ReplayMaxMessages <= 0 {
+		env.fail("REPLAY_MAX_MESSAGES", errors.New("must be positive"))
+	}
+	if cfg.TargetConnectTimeout <= 0 {
+		env.fail("TARGET_CONNECT_TIMEOUT", errors.New("must be positive"))
+	}
+	if cfg.TargetResponseHeaderTimeout < 0 {
+		env.fail("TARGET_RESPONSE_HEADER_TIMEOUT", errors.New("must not be negative"))
+	}
+	if cfg.TargetTotalTimeout <= 0 {
+		env.fail("TARGET_TOTAL_TIMEOUT", errors.New("must be positive"))
+	}
+	if cfg.Serialization == "avro" && cfg.SchemaRegistryURL == "" {
+		env.fail("SCHEMA_REGISTRY_URL", errors.New("required for avro serialization"))
+	}
+	if cfg.TargetOAuthTokenURL != "" && cfg.TargetOAuthClientID == "" {
+		env.fail("TARGET_OAUTH_CLIENT_ID", errors.New("required with TARGET_OAUTH_TOKEN_URL"))
+	}
+	for i, host := range cfg.CallbackAllowedHosts {
+		cfg.CallbackAllowedHosts[i] = strings.ToLower(host)
+	}
+	if cfg.CallbackTimeout <= 0 {
+		env.fail("CALLBACK_TIMEOUT", errors.New("must be positive"))
+	}
+	if cfg.BatchSize < 0 {
+		env.fail("BATCH_SIZE", errors.New("must not be negative"))
+	}
+	if cfg.BatchSize > 0 && cfg.ConsumerWorkers > 1 {
+		env.fail("CONSUMER_WORKERS", errors.New("cannot be combined with BATCH_SIZE"))
+	}
+	if cfg.BatchSize > 0 && cfg.Sink == "http" && cfg.TargetBatchURL == "" {
+		env.fail("TARGET_BATCH_URL", errors.New("required with BATCH_SIZE"))
+	}
+	if cfg.BatchWindow <= 0 {
+		env.fail("BATCH_WINDOW", errors.New("must be positive"))
+	}
+	if cfg.Sink == "http" && cfg.TargetURL == "" {
+		env.fail("TARGET_URL", errors.New("required for http sink"))
+	}
+
+	return cfg, errors.Join(env.errs...)
+}
+
+// ProduceTopic — топик в который пишутся входящие факты
+func (c Config) ProduceTopic() string {
+	return c.Topics[0]
+}
+
+// configSetting — одна действующая настройка, как ее видно в логе и GET /admin/config
+type configSetting struct {
+	Key   string
+	Value string
+}
+
+// Settings возвращает действующие настройки по порядку. Секреты заменяются на "***",
+// пароли в адресах скрываются, поэтому результат можно писать в лог и отдавать наружу
+func (c Config) Settings() []configSetting {
+	pattern := ""
+	if c.TopicPattern != nil {
+		pattern = c.TopicPattern.String()
+	}
+	return []configSetting{
+		{"brokers", strings.Join(c.Brokers, ",")},
+		{"kafka_version", c.KafkaVersion.String()},
+		{"kafka_version_auto", strconv.FormatBool(c.KafkaVersionAuto)},
+		{"group", c.Group},
+		{"topics", strings.Join(c.Topics, ",")},
+		{"consume_partitions", fmt.Sprint(c.ConsumePartitions)},
+		{"topic_pattern", pattern},
+		{"topic_refresh_interval", c.TopicRefreshInterval.String()},
+		{"missing_topics", c.MissingTopicsPolicy},
+		{"max_message_bytes", strconv.Itoa(c.MaxMessageBytes)},
+		{"partitioner", c.Partitioner},
+		{"flush_frequency", c.FlushFrequency.String()},
+		{"flush_messages", strconv.Itoa(c.FlushMessages)},
+		{"flush_bytes", strconv.Itoa(c.FlushBytes)},
+		{"flush_max_messages", strconv.Itoa(c.FlushMaxMessages)},
+		{"fetch_min_bytes", strconv.Itoa(int(c.FetchMinBytes))},
+		{"fetch_default_bytes", strconv.Itoa(int(c.FetchDefaultBytes))},
+		{"fetch_max_bytes", strconv.Itoa(int(c.FetchMaxBytes))},
+		{"channel_buffer_size", strconv.Itoa(c.ChannelBufferSize)},
+		{"consumer_max_attempts", strconv.Itoa(c.ConsumerMaxAttempts)},
+		{"session_timeout", c.SessionTimeout.String()},
+		{"heartbeat_interval", c.HeartbeatInterval.String()},
+		{"rebalance_timeout", c.RebalanceTimeout.String()},
+		{"consumer_workers", strconv.Itoa(c.ConsumerWorkers)},
+		{"commit_batch_size", strconv.Itoa(c.CommitBatchSize)},
+		{"commit_interval", c.CommitInterval.String()},
+		{"log_residence_time", strconv.FormatBool(c.LogResidenceTime)},
+		{"error_log_interval", c.ErrorLogInterval.String()},
+		{"reconcile_log_interval", c.ReconcileLogInterval.String()},
+		{"shutdown_timeout", c.ShutdownTimeout.String()},
+		{"max_delivery_attempts", strconv.Itoa(c.MaxDeliveryAttempts)},
+		{"retry_topic", c.RetryTopic},
+		{"retry_backoff", c.RetryBackoff.String()},
+		{"retry_backoff_max", c.RetryBackoffMax.String()},
+		{"dlq_topic", c.DeadLetterTopic},
+		{"create_topics", strconv.FormatBool(c.CreateTopics)},
+		{"create_topics_partitions", strconv.Itoa(int(c.CreateTopicsPartitions))},
+		{"create_topics_replication", strconv.Itoa(int(c.CreateTopicsReplication))},
+		{"route_prefix", c.RoutePrefix},
+		{"http_read_timeout", c.HTTPReadTimeout.String()},
+		{"http_write_timeout", c.HTTPWriteTimeout.String()},
+		{"http_idle_timeout", c.HTTPIdleTimeout.String()},
+		{"http_handler_timeout", c.HTTPHandlerTimeout.String()},
+		{"slow_request_threshold", c.SlowRequestThreshold.String()},
+		{"metrics_auth_token", redact(c.MetricsAuthToken)},
+		{"admin_auth_token", redact(c.AdminAuthToken)},
+		{"metrics_backend", c.MetricsBackend},
+		{"statsd_addr", c.StatsdAddr},
+		{"statsd_prefix", c.StatsdPrefix},
+		{"replay_max_messages", strconv.Itoa(c.ReplayMaxMessages)},
+		{"produce_timeout", c.ProduceTimeout.String()},
+		{"async_queue_size", strconv.Itoa(c.AsyncQueueSize)},
+		{"multipart_memory_limit", strconv.FormatInt(c.MultipartMemoryLimit, 10)},
+		{"strict_form_fields", strconv.FormatBool(c.StrictFormFields)},
+		{"accept_camel_case", strconv.FormatBool(c.AcceptCamelCase)},
+		{"period_keys", strings.Join(c.PeriodKeys, ",")},
+		{"debug_log_bodies", strconv.FormatBool(c.DebugLogBodies)},
+		{"debug_redact_fields", strings.Join(c.DebugRedactFields, ",")},
+		{"serialization", c.Serialization},
+		{"schema_registry_url", redactRawURL(c.SchemaRegistryURL)},
+		{"schema_registry_subject", c.SchemaRegistrySubject},
+		{"delivery_semantics", c.DeliverySemantics},
+		{"message_transform", c.MessageTransform},
+		{"message_static_fields", c.MessageStaticFields},
+		{"sink", c.Sink},
+		{"target_url", redactRawURL(c.TargetURL)},
+		{"target_method", c.TargetMethod},
+		{"target_token", redact(c.TargetToken)},
+		{"target_oauth_token_url", redactRawURL(c.TargetOAuthTokenURL)},
+		{"target_oauth_client_id", c.TargetOAuthClientID},
+		{"target_oauth_client_secret", redact(c.TargetOAuthClientSecret)},
+		{"target_oauth_scopes", strings.Join(c.TargetOAuthScopes, ",")},
+		{"target_delete_url", redactRawURL(c.TargetDeleteURL)},
+		{"target_mirror_url", redactRawURL(c.TargetMirrorURL)},
+		{"target_mirror_token", redact(c.TargetMirrorToken)},
+		{"target_batch_url", redactRawURL(c.TargetBatchURL)},
+		{"target_omit_zero_fact_id", strconv.FormatBool(c.TargetOmitZeroFactID)},
+		{"callback_allowed_hosts", strings.Join(c.CallbackAllowedHosts, ",")},
+		{"callback_timeout", c.CallbackTimeout.String()},
+		{"batch_size", strconv.Itoa(c.BatchSize)},
+		{"batch_window", c.BatchWindow.String()},
+		{"target_proxy_url", redactURL(c.TargetProxyURL)},
+		{"target_connect_timeout", c.TargetConnectTimeout.String()},
+		{"target_response_header_timeout", c.TargetResponseHeaderTimeout.String()},
+		{"target_total_timeout", c.TargetTotalTimeout.String()},
+		{"target_field_mapping", fmt.Sprint(c.TargetFieldMapping)},
+		{"success_status_codes", fmt.Sprint(c.SuccessStatusCodes)},
+		{"retryable_status_codes", fmt.Sprint(c.RetryableStatusCodes)},
+		{"success_field", c.SuccessField},
+		{"success_value", c.SuccessValue},
+		{"target_client_cert", c.TargetClientCert},
+		{"target_client_key", c.TargetClientKey},
+		{"target_ca_cert", c.TargetCACert},
+	}
+}
+
+// String выводит настройки одной строкой key=value для лога, значения с пробелами в кавычках
+func (c Config) String() string {
+	settings := c.Settings()
+	fields := make([]string, 0, len(settings))
+	for _, setting := range settings {
+		value := setting.Value
+		if strings.ContainsAny(value, " \t\"") {
+			value = strconv.Quote(value)
+		}
+		fields = append(fields, setting.Key+"="+value)
+	}
+	return strings.Join(fields, " ")
+}
+
+// redact скрывает значение секрета, оставляя видимым только факт что он задан
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "***"
+}
+
+// redactURL скрывает пароль в адресе, например у прокси с авторизацией
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// redactRawURL скрывает пароль в адресе из строки, например user:pass@ в SCHEMA_REGISTRY_URL.
+// Адрес, который не разбирается, скрывается целиком
+func redactRawURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "***"
+	}
+	return u.Redacted()
+}
+
+// normalizeRoutePrefix приводит префикс к виду "/buffer": с ведущим слешем и без завершающего
+func normalizeRoutePrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// envReader читает переменные окружения и копит ошибки разбора
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) fail(key string, err error) {
+	e.errs = append(e.errs, fmt.Errorf("%s: %w", key, err))
+}
+
+// string возвращает значение переменной окружения или значение по умолчанию
+func (e *envReader) string(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// list разбирает список через запятую, пустые элементы пропускаются
+func (e *envReader) list(key, fallback string) []string {
+	var items []string
+	for _, item := range strings.Split(e.string(key, fallback), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// intList разбирает список целых чисел через запятую
+func (e *envReader) intList(key, fallback string) []int {
+	var numbers []int
+	for _, item := range e.list(key, fallback) {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			e.fail(key, err)
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+func (e *envReader) int(key string, fallback int) int {
+	value := e.string(key, "")
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return n
+}
+
+func (e *envReader) bool(key string, fallback bool) bool {
+	value := e.string(key, "")
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return b
+}
+
+// duration разбирает длительность в формате time.ParseDuration, например "30s"
+func (e *envReader) duration(key string, fallback time.Duration) time.Duration {
+	value := e.string(key, "")
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return d
+}
+
+// oneOf возвращает значение из списка допустимых, регистр не учитывается
+func (e *envReader) oneOf(key, fallback string, allowed ...string) string {
+	value := strings.TrimSpace(e.string(key, fallback))
+	for _, candidate := range allowed {
+		if strings.EqualFold(value, candidate) {
+			return candidate
+		}
+	}
+	e.fail(key, fmt.Errorf("invalid value %q, expected one of %v", value, allowed))
+	return fallback
+}
+
+func (e *envReader) kafkaVersion(key string, fallback sarama.KafkaVersion) sarama.KafkaVersion {
+	value := e.string(key, "")
+	if value == "" || strings.EqualFold(value, "auto") {
+		return fallback
+	}
+	version, err := sarama.ParseKafkaVersion(value)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return version
+}
+
+// partitions разбирает список номеров партиций через запятую
+func (e *envReader) partitions(key string) []int32 {
+	var partitions []int32
+	for _, n := range e.intList(key, "") {
+		if n < 0 || n > math.MaxInt32 {
+			e.fail(key, fmt.Errorf("invalid partition %d", n))
+			continue
+		}
+		partitions = append(partitions, int32(n))
+	}
+	return partitions
+}
+
+// regexp компилирует регулярное выражение, пустое значение дает nil
+func (e *envReader) regexp(key string) *regexp.Regexp {
+	value := e.string(key, "")
+	if value == "" {
+		return nil
+	}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		e.fail(key, err)
+		return nil
+	}
+	return re
+}
+
+// proxyURL разбирает адрес прокси, поддерживаются схемы http, https и socks5
+func (e *envReader) proxyURL(key string) *url.URL {
+	value := e.string(key, "")
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		e.fail(key, err)
+		return nil
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		e.fail(key, fmt.Errorf("unsupported proxy scheme %q, expected http, https or socks5", u.Scheme))
+		return nil
+	}
+	if u.Host == "" {
+		e.fail(key, errors.New("proxy host is required"))
+		return nil
+	}
+	return u
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigAcceptCamelCase(t *testing.T) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.AcceptCamelCase {
+		t.Error("AcceptCamelCase is enabled by default")
+	}
+
+	t.Setenv("ACCEPT_CAMEL_CASE", "true")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !cfg.AcceptCamelCase {
+		t.Error("ACCEPT_CAMEL_CASE=true is not applied")
+	}
+}
+
+func TestLoadConfigRetryTopicMustBeConsumed(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"in topics", map[string]string{"KAFKA_TOPICS": "kek,kek.retry", "KAFKA_RETRY_TOPIC": "kek.retry"}, false},
+		{"not in topics", map[string]string{"KAFKA_TOPICS": "kek", "KAFKA_RETRY_TOPIC": "kek.retry"}, true},
+		{"matches pattern", map[string]string{"KAFKA_TOPIC_PATTERN": "^kek.*$", "KAFKA_RETRY_TOPIC": "kek.retry"}, false},
+		{"does not match pattern", map[string]string{"KAFKA_TOPIC_PATTERN": "^facts-.+$", "KAFKA_RETRY_TOPIC": "kek.retry"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := LoadConfig()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("LoadConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "KAFKA_RETRY_TOPIC") {
+				t.Errorf("error %q does not name KAFKA_RETRY_TOPIC", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDeadLetterTopicMustNotBeConsumed(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"not consumed", map[string]string{"KAFKA_TOPICS": "kek", "KAFKA_DLQ_TOPIC": "kek.dlq"}, false},
+		{"in topics", map[string]string{"KAFKA_TOPICS": "kek,kek.dlq", "KAFKA_DLQ_TOPIC": "kek.dlq"}, true},
+		{"does not match pattern", map[string]string{"KAFKA_TOPIC_PATTERN": "^facts-.+$", "KAFKA_DLQ_TOPIC": "kek.dlq"}, false},
+		{"matches pattern", map[string]string{"KAFKA_TOPIC_PATTERN": "^kek.*$", "KAFKA_DLQ_TOPIC": "kek.dlq"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := LoadConfig()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("LoadConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "KAFKA_DLQ_TOPIC") {
+				t.Errorf("error %q does not name KAFKA_DLQ_TOPIC", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigHTTPTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantKey string
+	}{
+		{"defaults", nil, ""},
+		{"zero read timeout", map[string]string{"HTTP_READ_TIMEOUT": "0s"}, "HTTP_READ_TIMEOUT"},
+		{"zero write timeout", map[string]string{"HTTP_WRITE_TIMEOUT": "0s"}, "HTTP_WRITE_TIMEOUT"},
+		{"zero idle timeout", map[string]string{"HTTP_IDLE_TIMEOUT": "0s"}, "HTTP_IDLE_TIMEOUT"},
+		{"zero handler timeout", map[string]string{"HTTP_HANDLER_TIMEOUT": "0s"}, "HTTP_HANDLER_TIMEOUT"},
+		{"handler not below write", map[string]string{"HTTP_HANDLER_TIMEOUT": "30s", "HTTP_WRITE_TIMEOUT": "30s"}, "HTTP_HANDLER_TIMEOUT"},
+		{"produce not below handler", map[string]string{"PRODUCE_TIMEOUT": "25s"}, "PRODUCE_TIMEOUT"},
+		{"unbounded produce", map[string]string{"PRODUCE_TIMEOUT": "0s"}, ""},
+		{"shutdown not above handler", map[string]string{"SHUTDOWN_TIMEOUT": "25s"}, "SHUTDOWN_TIMEOUT"},
+		{"unbounded shutdown", map[string]string{"SHUTDOWN_TIMEOUT": "0s"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := LoadConfig()
+			if tt.wantKey == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantKey) {
+				t.Errorf("LoadConfig error = %v, want an error about %s", err, tt.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// logThrottle ограничивает одинаковые по смыслу ошибки в логе: первая пишется сразу,
+// следующие не чаще раза в interval вместе с числом пропущенных. interval <= 0 отключает ограничение
+type logThrottle struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func newLogThrottle(interval time.Duration) *logThrottle {
+	return &logThrottle{interval: interval}
+}
+
+func (t *logThrottle) Printf(format string, args ...any) {
+	if t.interval <= 0 {
+		log.Printf(format, args...)
+		return
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	if !t.last.IsZero() && now.Sub(t.last) < t.interval {
+		t.suppressed++
+		t.mu.Unlock()
+		return
+	}
+	suppressed := t.suppressed
+	t.last, t.suppressed = now, 0
+	t.mu.Unlock()
+
+	if suppressed > 0 {
+		log.Printf("%d similar errors suppressed in the last %s\n", suppressed, t.interval)
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,847 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+func TestNormalizeCamelCaseForm(t *testing.T) {
+	t.Run("camelCase only", func(t *testing.T) {
+		form := url.Values{"periodStart": {"2024-01-01"}, "IndicatorToMoId": {"42"}, "comment": {"ok"}}
+		normalizeCamelCaseForm(form)
+
+		if got := form.Get("period_start"); got != "2024-01-01" {
+			t.Errorf("period_start = %q, want 2024-01-01", got)
+		}
+		if got := form.Get("indicator_to_mo_id"); got != "42" {
+			t.Errorf("indicator_to_mo_id = %q, want 42", got)
+		}
+		if got := form.Get("comment"); got != "ok" {
+			t.Errorf("comment = %q, want ok", got)
+		}
+		if _, ok := form["periodStart"]; ok {
+			t.Error("camelCase key periodStart was not removed")
+		}
+	})
+
+	t.Run("both spellings prefer snake_case", func(t *testing.T) {
+		form := url.Values{"period_start": {"snake"}, "periodStart": {"camel"}}
+		normalizeCamelCaseForm(form)
+
+		if got := form.Get("period_start"); got != "snake" {
+			t.Errorf("period_start = %q, want snake", got)
+		}
+	})
+
+	t.Run("both spellings are duplicates in strict mode", func(t *testing.T) {
+		form := url.Values{"period_start": {"snake"}, "periodStart": {"camel"}}
+		normalizeCamelCaseForm(form)
+
+		field, ok := duplicateFormField(&http.Request{Form: form})
+		if !ok || field != "period_start" {
+			t.Errorf("duplicateFormField = %q, %v, want period_start, true", field, ok)
+		}
+	})
+}
+
+func TestMain(m *testing.M) {
+	// логи consumer в тестах только мешают читать результат
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeSink доставляет сообщения через deliver и запоминает успешно доставленные
+type fakeSink struct {
+	deliver func(ctx context.Context, message Message) error
+
+	mu        sync.Mutex
+	delivered []Message
+	deleted   []int
+}
+
+func (s *fakeSink) Deliver(ctx context.Context, message Message) error {
+	if s.deliver != nil {
+		if err := s.deliver(ctx, message); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.delivered = append(s.delivered, message)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fakeSink) Delete(_ context.Context, factID int) error {
+	s.mu.Lock()
+	s.deleted = append(s.deleted, factID)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fakeSink) deliveredMessages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.delivered)
+}
+
+// rejectingBatchSink не принимает пачки, и факты уходят по одному в fakeSink
+type rejectingBatchSink struct {
+	*fakeSink
+}
+
+func (rejectingBatchSink) DeliverBatch(context.Context, []Message) error {
+	return errors.New("batch endpoint unavailable")
+}
+
+// fakeMarker запоминает пометки смещений вместо сессии consumer group. check вызывается
+// при каждой пометке, чтобы проверить инвариант в момент пометки, а не только в конце
+type fakeMarker struct {
+	check func(message *sarama.ConsumerMessage)
+
+	mu      sync.Mutex
+	marked  []int64
+	commits int
+}
+
+func (m *fakeMarker) MarkMessage(message *sarama.ConsumerMessage, _ string) {
+	if m.check != nil {
+		m.check(message)
+	}
+	m.mu.Lock()
+	m.marked = append(m.marked, message.Offset)
+	m.mu.Unlock()
+}
+
+func (m *fakeMarker) Commit() {
+	m.mu.Lock()
+	m.commits++
+	m.mu.Unlock()
+}
+
+// next — смещение, с которого партиция будет прочитана следующей сессией
+func (m *fakeMarker) next() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.marked) == 0 {
+		return 0
+	}
+	return slices.Max(m.marked) + 1
+}
+
+func (m *fakeMarker) markedOffsets() []int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.marked)
+}
+
+// fakeProducer записывает сообщения в память, остальные методы SyncProducer не нужны
+type fakeProducer struct {
+	sarama.SyncProducer
+	err error
+
+	mu     sync.Mutex
+	sent   []*sarama.ProducerMessage
+	closed bool
+}
+
+func (p *fakeProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, 0, p.err
+	}
+	p.sent = append(p.sent, msg)
+	return msg.Partition, int64(len(p.sent) - 1), nil
+}
+
+func (p *fakeProducer) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *fakeProducer) sentTo(topic string) []*sarama.ProducerMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var sent []*sarama.ProducerMessage
+	for _, msg := range p.sent {
+		if msg.Topic == topic {
+			sent = append(sent, msg)
+		}
+	}
+	return sent
+}
+
+func testConfig(t testing.TB) Config {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	// повторы на месте в тестах не должны ждать секунды
+	cfg.RetryBackoff = time.Millisecond
+	cfg.RetryBackoffMax = 5 * time.Millisecond
+	return cfg
+}
+
+func newTestConsumer(cfg Config, sink Sink, producer sarama.SyncProducer) *Consumer {
+	return &Consumer{
+		cfg:            cfg,
+		sink:           sink,
+		codec:          jsonCodec{},
+		validate:       newMessageValidator(cfg),
+		transform:      identityTransform,
+		producer:       producer,
+		deliveryErrors: newLogThrottle(0),
+		reconciliation: newReconciliation(),
+	}
+}
+
+// testFact — валидный факт, value хранит смещение, чтобы sink знал какое сообщение доставляет
+func testFact(offset int64, indicatorID int) Message {
+	return Message{
+		PeriodStart:     "2024-01-01",
+		PeriodEnd:       "2024-01-31",
+		PeriodKey:       "month",
+		IndicatorToMoID: indicatorID,
+		Value:           int(offset) + 1,
+		FactTime:        "2024-01-31",
+		AuthUserID:      1,
+	}
+}
+
+func testFactMessage(t testing.TB, offset int64, indicatorID int) *sarama.ConsumerMessage {
+	t.Helper()
+	value, err := json.Marshal(testFact(offset, indicatorID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sarama.ConsumerMessage{
+		Topic:     "kek",
+		Partition: 0,
+		Offset:    offset,
+		Key:       []byte(strconv.Itoa(indicatorID)),
+		Value:     value,
+	}
+}
+
+// consumedMessage — сообщение, записанное producer, каким его прочитает consumer
+func consumedMessage(t testing.TB, msg *sarama.ProducerMessage, offset int64) *sarama.ConsumerMessage {
+	t.Helper()
+	message := &sarama.ConsumerMessage{Topic: msg.Topic, Partition: msg.Partition, Offset: offset}
+	var err error
+	if msg.Key != nil {
+		if message.Key, err = msg.Key.Encode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg.Value != nil {
+		if message.Value, err = msg.Value.Encode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, header := range msg.Headers {
+		message.Headers = append(message.Headers, &sarama.RecordHeader{Key: header.Key, Value: header.Value})
+	}
+	return message
+}
+
+// messageChannel возвращает закрытый канал с сообщениями партиции
+func messageChannel(messages ...*sarama.ConsumerMessage) <-chan *sarama.ConsumerMessage {
+	ch := make(chan *sarama.ConsumerMessage, len(messages))
+	for _, message := range messages {
+		ch <- message
+	}
+	close(ch)
+	return ch
+}
+
+// consumeAll прогоняет сообщения через consumePartition до закрытия канала
+func consumeAll(t testing.TB, consumer *Consumer, offsets offsetMarker, messages ...*sarama.ConsumerMessage) {
+	t.Helper()
+	if err := consumer.consumePartition(context.Background(), messageChannel(messages...), offsets); err != nil {
+		t.Fatalf("consumePartition: %v", err)
+	}
+}
+
+// TestConsumePartitionStress доставляет партицию со случайными ошибками и таймаутами API,
+// по одному и с CONSUMER_WORKERS, и проверяет at-least-once: каждое сообщение доставлено,
+// а смещение помечается только за непрерывно доставленными сообщениями и не убывает
+func TestConsumePartitionStress(t *testing.T) {
+	const messages = 400
+	const indicators = 16
+
+	for _, workers := range []int{1, 4, 8} {
+		for seed := int64(1); seed <= 5; seed++ {
+			t.Run(fmt.Sprintf("workers=%d/seed=%d", workers, seed), func(t *testing.T) {
+				t.Parallel()
+				rng := rand.New(rand.NewSource(seed))
+
+				// исходы каждой попытки определяются заранее: rng не потокобезопасен
+				failures := make([][]error, messages)
+				delays := make([]time.Duration, messages)
+				batch := make([]*sarama.ConsumerMessage, messages)
+				for i := range batch {
+					for rng.Float64() < 0.05 {
+						if rng.Intn(2) == 0 {
+							failures[i] = append(failures[i], errors.New("connection reset"))
+						} else {
+							failures[i] = append(failures[i], context.DeadlineExceeded)
+						}
+					}
+					delays[i] = time.Duration(rng.Intn(300)) * time.Microsecond
+					batch[i] = testFactMessage(t, int64(i), rng.Intn(indicators)+1)
+				}
+
+				var mu sync.Mutex
+				attempts := make([]int, messages)
+				delivered := make([]bool, messages)
+				sink := &fakeSink{deliver: func(ctx context.Context, message Message) error {
+					offset := message.Value - 1
+					time.Sleep(delays[offset])
+					mu.Lock()
+					defer mu.Unlock()
+					attempts[offset]++
+					if attempts[offset] <= len(failures[offset]) {
+						return failures[offset][attempts[offset]-1]
+					}
+					delivered[offset] = true
+					return nil
+				}}
+				marker := &fakeMarker{check: func(message *sarama.ConsumerMessage) {
+					mu.Lock()
+					defer mu.Unlock()
+					for offset := int64(0); offset <= message.Offset; offset++ {
+						if !delivered[offset] {
+							t.Errorf("offset %d marked before offset %d was delivered", message.Offset, offset)
+							return
+						}
+					}
+				}}
+
+				cfg := testConfig(t)
+				cfg.ConsumerWorkers = workers
+				consumeAll(t, newTestConsumer(cfg, sink, &fakeProducer{}), marker, batch...)
+
+				for offset, ok := range delivered {
+					if !ok {
+						t.Errorf("offset %d was never delivered", offset)
+					}
+					if want := len(failures[offset]) + 1; attempts[offset] != want {
+						t.Errorf("offset %d: %d attempts, want %d", offset, attempts[offset], want)
+					}
+				}
+				if marked := marker.markedOffsets(); !slices.IsSorted(marked) {
+					t.Errorf("marked offsets are not monotonic: %v", marked)
+				}
+				if got := marker.next(); got != messages {
+					t.Errorf("next offset = %d, want %d", got, messages)
+				}
+			})
+		}
+	}
+}
+
+// TestTransientFailureRetriedInPlace проверяет, что сообщение, которое API не принял с первого
+// раза, повторяется раньше следующего, и после успеха помечены оба: по одному, с
+// CONSUMER_WORKERS и при отправке по одному из непринятой пачки
+func TestTransientFailureRetriedInPlace(t *testing.T) {
+	for _, mode := range []string{"sequential", "workers", "batch"} {
+		t.Run(mode, func(t *testing.T) {
+			var order []int
+			failed := false
+			sink := &fakeSink{deliver: func(_ context.Context, message Message) error {
+				order = append(order, message.Value-1)
+				if !failed {
+					failed = true
+					return context.DeadlineExceeded
+				}
+				return nil
+			}}
+
+			cfg := testConfig(t)
+			consumer := newTestConsumer(cfg, sink, &fakeProducer{})
+			switch mode {
+			case "workers":
+				consumer.cfg.ConsumerWorkers = 4
+			case "batch":
+				consumer.cfg.BatchSize = 10
+				consumer.batches = rejectingBatchSink{sink}
+			}
+			marker := &fakeMarker{}
+			consumeAll(t, consumer, marker, testFactMessage(t, 0, 7), testFactMessage(t, 1, 7))
+
+			if !slices.Equal(order, []int{0, 0, 1}) {
+				t.Errorf("delivery attempts by offset = %v, want [0 0 1]", order)
+			}
+			if got := marker.markedOffsets(); !slices.Equal(got, []int64{0, 1}) {
+				t.Errorf("marked offsets = %v, want [0 1]", got)
+			}
+		})
+	}
+}
+
+// TestRetryInPlaceStopsOnSessionEnd проверяет, что повтор прерывается с завершением сессии,
+// а недоставленное сообщение и следующие за ним не помечаются
+func TestRetryInPlaceStopsOnSessionEnd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attempts := 0
+	sink := &fakeSink{deliver: func(context.Context, Message) error {
+		attempts++
+		if attempts == 3 {
+			cancel()
+		}
+		return errors.New("downstream unavailable")
+	}}
+	marker := &fakeMarker{}
+	consumer := newTestConsumer(testConfig(t), sink, &fakeProducer{})
+	if err := consumer.consumePartition(ctx, messageChannel(testFactMessage(t, 0, 7), testFactMessage(t, 1, 7)), marker); err != nil {
+		t.Fatalf("consumePartition: %v", err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+	if got := marker.markedOffsets(); len(got) != 0 {
+		t.Errorf("marked offsets = %v, want none", got)
+	}
+}
+
+// fakeConsumerGroup — сессия Consume длится до отмены ctx, как у sarama, или сразу
+// возвращает err. Каждый вызов отправляет список топиков в sessions
+type fakeConsumerGroup struct {
+	err      error
+	sessions chan []string
+}
+
+func newFakeConsumerGroup(err error) *fakeConsumerGroup {
+	return &fakeConsumerGroup{err: err, sessions: make(chan []string, 10)}
+}
+
+func (g *fakeConsumerGroup) Consume(ctx context.Context, topics []string, _ sarama.ConsumerGroupHandler) error {
+	g.sessions <- topics
+	if g.err != nil {
+		return g.err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// runConsumeGroup запускает consumeGroup в горутине и возвращает канал с ее результатом
+func runConsumeGroup(ctx context.Context, group consumerGroup, subscription *topicSubscription) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- consumeGroup(ctx, group, subscription, &Consumer{})
+	}()
+	return result
+}
+
+func waitSession(t *testing.T, group *fakeConsumerGroup) []string {
+	t.Helper()
+	select {
+	case topics := <-group.sessions:
+		return topics
+	case <-time.After(time.Second):
+		t.Fatal("consumer group session was not started")
+		return nil
+	}
+}
+
+func waitResult(t *testing.T, result <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("consumeGroup did not return")
+		return nil
+	}
+}
+
+func TestConsumeGroupStopsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	group := newFakeConsumerGroup(nil)
+	result := runConsumeGroup(ctx, group, newTopicSubscription([]string{"kek"}))
+
+	if topics := waitSession(t, group); !slices.Equal(topics, []string{"kek"}) {
+		t.Errorf("session topics = %v, want [kek]", topics)
+	}
+	cancel()
+	if err := waitResult(t, result); err != nil {
+		t.Errorf("consumeGroup = %v, want nil", err)
+	}
+	if len(group.sessions) != 0 {
+		t.Error("a new session was started after the context was cancelled")
+	}
+}
+
+func TestConsumeGroupStopsOnClosedConsumerGroup(t *testing.T) {
+	group := newFakeConsumerGroup(sarama.ErrClosedConsumerGroup)
+	result := runConsumeGroup(context.Background(), group, newTopicSubscription([]string{"kek"}))
+
+	waitSession(t, group)
+	if err := waitResult(t, result); err != nil {
+		t.Errorf("consumeGroup = %v, want nil", err)
+	}
+}
+
+func TestConsumeGroupReturnsConsumeError(t *testing.T) {
+	group := newFakeConsumerGroup(sarama.ErrOutOfBrokers)
+	result := runConsumeGroup(context.Background(), group, newTopicSubscription([]string{"kek"}))
+
+	waitSession(t, group)
+	if err := waitResult(t, result); !errors.Is(err, sarama.ErrOutOfBrokers) {
+		t.Errorf("consumeGroup = %v, want %v", err, sarama.ErrOutOfBrokers)
+	}
+}
+
+func TestConsumeGroupRestartsSessionOnSubscriptionChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	group := newFakeConsumerGroup(nil)
+	subscription := newTopicSubscription(nil)
+	result := runConsumeGroup(ctx, group, subscription)
+
+	// без топиков сессия не начинается, пока шаблону ничего не подошло
+	subscription.update([]string{"facts.a"})
+	if topics := waitSession(t, group); !slices.Equal(topics, []string{"facts.a"}) {
+		t.Errorf("first session topics = %v, want [facts.a]", topics)
+	}
+
+	subscription.update([]string{"facts.a", "facts.b"})
+	if topics := waitSession(t, group); !slices.Equal(topics, []string{"facts.a", "facts.b"}) {
+		t.Errorf("second session topics = %v, want [facts.a facts.b]", topics)
+	}
+
+	cancel()
+	if err := waitResult(t, result); err != nil {
+		t.Errorf("consumeGroup = %v, want nil", err)
+	}
+}
+
+// TestTombstoneKeyedLikeFacts проверяет, что tombstone пишется с ключом показателя, как его
+// факты, а consumer берет id факта из заголовка. Tombstone без заголовка нечитаемый и пропускается
+func TestTombstoneKeyedLikeFacts(t *testing.T) {
+	cfg := testConfig(t)
+	producer := &fakeProducer{}
+	if err := produceTombstone(cfg, producer, 7, 42, 0); err != nil {
+		t.Fatal(err)
+	}
+	fact, err := newFactMessage(cfg, jsonCodec{}, testFact(0, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstone := producer.sentTo(cfg.ProduceTopic())[0]
+	if tombstone.Key != fact.Key {
+		t.Errorf("tombstone key = %v, want fact key %v", tombstone.Key, fact.Key)
+	}
+
+	headerless := &sarama.ConsumerMessage{Topic: "kek", Offset: 1, Key: []byte("43")}
+	sink := &fakeSink{}
+	marker := &fakeMarker{}
+	consumeAll(t, newTestConsumer(cfg, sink, &fakeProducer{}), marker, consumedMessage(t, tombstone, 0), headerless)
+	if !slices.Equal(sink.deleted, []int{42}) {
+		t.Errorf("deleted facts = %v, want [42]", sink.deleted)
+	}
+	if got := marker.next(); got != 2 {
+		t.Errorf("next offset = %d, want 2", got)
+	}
+}
+
+// TestRetryLeavesPartitionToProducer проверяет, что повтор не переносит номер партиции исходного
+// сообщения: с KAFKA_PARTITIONER=manual его может не быть в KAFKA_RETRY_TOPIC
+func TestRetryLeavesPartitionToProducer(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxDeliveryAttempts = 3
+	cfg.RetryTopic = "kek.retry"
+	cfg.DeadLetterTopic = "kek.dlq"
+	sink := &fakeSink{deliver: func(context.Context, Message) error { return context.DeadlineExceeded }}
+	producer := &fakeProducer{}
+
+	message := testFactMessage(t, 0, 7)
+	message.Partition = 5
+	marker := &fakeMarker{}
+	consumeAll(t, newTestConsumer(cfg, sink, producer), marker, message)
+
+	retries := producer.sentTo(cfg.RetryTopic)
+	if len(retries) != 1 {
+		t.Fatalf("retry writes = %d, want 1", len(retries))
+	}
+	if retries[0].Partition != 0 {
+		t.Errorf("retry partition = %d, want it chosen by the partitioner", retries[0].Partition)
+	}
+	if key, _ := retries[0].Key.Encode(); string(key) != "7" {
+		t.Errorf("retry key = %q, want %q", key, "7")
+	}
+	if got := marker.next(); got != 1 {
+		t.Errorf("next offset = %d, want 1", got)
+	}
+}
+
+// TestInvalidFactNotSkippedWithoutDLQ проверяет, что факт, не прошедший валидацию, уходит в DLQ,
+// а без KAFKA_DLQ_TOPIC не помечается и не пропускается, в отличие от мусора
+func TestInvalidFactNotSkippedWithoutDLQ(t *testing.T) {
+	invalid := testFact(0, 7)
+	invalid.PeriodKey = "decade"
+	value, err := json.Marshal(invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := func() []*sarama.ConsumerMessage {
+		return []*sarama.ConsumerMessage{
+			{Topic: "kek", Offset: 0, Value: value},
+			testFactMessage(t, 1, 7),
+		}
+	}
+
+	t.Run("with DLQ", func(t *testing.T) {
+		cfg := testConfig(t)
+		cfg.DeadLetterTopic = "kek.dlq"
+		producer := &fakeProducer{}
+		sink := &fakeSink{}
+		marker := &fakeMarker{}
+		consumeAll(t, newTestConsumer(cfg, sink, producer), marker, messages()...)
+
+		if got := len(producer.sentTo(cfg.DeadLetterTopic)); got != 1 {
+			t.Errorf("DLQ writes = %d, want 1", got)
+		}
+		if got := len(sink.deliveredMessages()); got != 1 {
+			t.Errorf("delivered = %d, want 1", got)
+		}
+		if got := marker.next(); got != 2 {
+			t.Errorf("next offset = %d, want 2", got)
+		}
+	})
+
+	t.Run("without DLQ", func(t *testing.T) {
+		// факт повторяется на месте до конца сессии
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		cfg := testConfig(t)
+		sink := &fakeSink{}
+		marker := &fakeMarker{}
+		if err := newTestConsumer(cfg, sink, &fakeProducer{}).consumePartition(ctx, messageChannel(messages()...), marker); err != nil {
+			t.Fatalf("consumePartition: %v", err)
+		}
+
+		if got := len(sink.deliveredMessages()); got != 0 {
+			t.Errorf("delivered = %d, want 0", got)
+		}
+		if got := marker.markedOffsets(); len(got) != 0 {
+			t.Errorf("marked offsets = %v, want none", got)
+		}
+	})
+}
+
+// TestUnreadableResponseDoesNotAbandonPartition проверяет, что нечитаемый ответ API на факт
+// не останавливает обработку партиции: факт повторяется, затем доставляется следующий, и
+// помечаются оба
+func TestUnreadableResponseDoesNotAbandonPartition(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+	}{
+		{"unmarshal error", func(w http.ResponseWriter) {
+			w.Write([]byte("<html>not json</html>"))
+		}},
+		{"read error", func(w http.ResponseWriter) {
+			// ответ короче заявленной длины: чтение тела обрывается
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte(`{"STATUS"`))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var received []string
+			answered := false
+			downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				value := r.FormValue("value")
+				mu.Lock()
+				defer mu.Unlock()
+				received = append(received, value)
+				if value == "1" && !answered {
+					answered = true
+					tt.respond(w)
+					return
+				}
+				w.Write([]byte(`{"STATUS":"OK"}`))
+			}))
+			defer downstream.Close()
+
+			cfg := testConfig(t)
+			marker := &fakeMarker{}
+			consumer := newTestConsumer(cfg, NewHTTPSink(downstream.URL, http.MethodPost, ""), &fakeProducer{})
+			consumeAll(t, consumer, marker, testFactMessage(t, 0, 7), testFactMessage(t, 1, 7))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(received, []string{"1", "1", "2"}) {
+				t.Errorf("downstream received values %v, want [1 1 2]", received)
+			}
+			if got := marker.markedOffsets(); !slices.Equal(got, []int64{0, 1}) {
+				t.Errorf("marked offsets = %v, want [0 1]", got)
+			}
+		})
+	}
+}
+
+// testPoisonMessage прогоняет нечитаемое сообщение и следующий за ним факт: с DLQ нечитаемое
+// пишется туда, без DLQ пропускается, и в обоих случаях партиция идет дальше
+func testPoisonMessage(t *testing.T, value []byte) {
+	t.Helper()
+	messages := func() []*sarama.ConsumerMessage {
+		return []*sarama.ConsumerMessage{
+			{Topic: "kek", Offset: 0, Key: []byte("7"), Value: value},
+			testFactMessage(t, 1, 7),
+		}
+	}
+
+	t.Run("with DLQ", func(t *testing.T) {
+		cfg := testConfig(t)
+		cfg.DeadLetterTopic = "kek.dlq"
+		producer := &fakeProducer{}
+		sink := &fakeSink{}
+		marker := &fakeMarker{}
+		consumeAll(t, newTestConsumer(cfg, sink, producer), marker, messages()...)
+
+		dead := producer.sentTo(cfg.DeadLetterTopic)
+		if len(dead) != 1 {
+			t.Fatalf("DLQ writes = %d, want 1", len(dead))
+		}
+		if got, _ := dead[0].Value.Encode(); !slices.Equal(got, value) {
+			t.Errorf("DLQ value = %q, want %q", got, value)
+		}
+		if !slices.Equal(marker.markedOffsets(), []int64{0, 1}) {
+			t.Errorf("marked offsets = %v, want [0 1]", marker.markedOffsets())
+		}
+		if got := len(sink.deliveredMessages()); got != 1 {
+			t.Errorf("delivered = %d, want 1", got)
+		}
+	})
+
+	t.Run("without DLQ", func(t *testing.T) {
+		cfg := testConfig(t)
+		producer := &fakeProducer{}
+		sink := &fakeSink{}
+		marker := &fakeMarker{}
+		consumeAll(t, newTestConsumer(cfg, sink, producer), marker, messages()...)
+
+		if len(producer.sent) != 0 {
+			t.Errorf("produced %d messages, want none", len(producer.sent))
+		}
+		if !slices.Equal(marker.markedOffsets(), []int64{0, 1}) {
+			t.Errorf("marked offsets = %v, want [0 1]", marker.markedOffsets())
+		}
+		if got := len(sink.deliveredMessages()); got != 1 {
+			t.Errorf("delivered = %d, want 1", got)
+		}
+	})
+}
+
+func TestGarbageMessageDoesNotWedgePartition(t *testing.T) {
+	testPoisonMessage(t, []byte{0xff, 0x00, 0x13, '{', 'n', 'o', 't'})
+}
+
+// пустое, но не null значение — не tombstone, а нечитаемое сообщение
+func TestEmptyValueDoesNotWedgePartition(t *testing.T) {
+	testPoisonMessage(t, []byte{})
+}
+
+// BenchmarkValidate сравнивает валидатор на каждый запрос, как было раньше, с общим из
+// newMessageValidator: общий кеширует разбор структуры Message и почти не выделяет память
+func BenchmarkValidate(b *testing.B) {
+	cfg := testConfig(b)
+	fact := testFact(0, 7)
+
+	b.Run("per request", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := newMessageValidator(cfg).Struct(fact); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("shared", func(b *testing.B) {
+		validate := newMessageValidator(cfg)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := validate.Struct(fact); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// shutdownEvents записывает шаги остановки в порядке их выполнения
+type shutdownEvents struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *shutdownEvents) add(event string) {
+	e.mu.Lock()
+	e.events = append(e.events, event)
+	e.mu.Unlock()
+}
+
+type closeRecordingProducer struct {
+	*fakeProducer
+	events *shutdownEvents
+}
+
+func (p closeRecordingProducer) Close() error {
+	p.events.add("producer closed")
+	return p.fakeProducer.Close()
+}
+
+// TestShutdownClosesProducerAfterHTTPServer проверяет порядок остановки: producer закрывается
+// только после остановки HTTP сервера, а факт, принятый запросом во время остановки сервера,
+// записывается в kafka до закрытия producer
+func TestShutdownClosesProducerAfterHTTPServer(t *testing.T) {
+	events := &shutdownEvents{}
+	producer := closeRecordingProducer{fakeProducer: &fakeProducer{}, events: events}
+	queue := newAsyncQueue(producer, 10)
+
+	parent, cancel := context.WithCancel(context.Background())
+	ctx, components := newSupervisor(parent)
+	components.run(ctx, "HTTP server", func(ctx context.Context) error {
+		<-ctx.Done()
+		// запрос, который завершается во время server.Shutdown
+		time.Sleep(20 * time.Millisecond)
+		if err := queue.enqueue(&sarama.ProducerMessage{Topic: "kek"}); err != nil {
+			t.Errorf("enqueue during HTTP shutdown: %v", err)
+		}
+		events.add("HTTP server stopped")
+		return nil
+	})
+	cancel()
+
+	if err := shutdown(components, queue, producer, producer); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if want := []string{"HTTP server stopped", "producer closed"}; !slices.Equal(events.events, want) {
+		t.Errorf("shutdown steps = %v, want %v", events.events, want)
+	}
+	if got := len(producer.sentTo("kek")); got != 1 {
+		t.Errorf("produced %d messages before close, want 1", got)
+	}
+}
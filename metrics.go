@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Метрики сервиса. Имена, типы и метки описаны в metricDefinitions, а значения пишутся
+// через Metrics, поэтому код не зависит от системы метрик, выбранной в METRICS_BACKEND
+const (
+	// ошибки валидации входящих фактов по полям, см. observeValidationErrors
+	metricValidationFailures = "buffer_validation_failures_total"
+	// ответы которые не удалось записать клиенту
+	metricResponseWriteFailures = "buffer_response_write_failures_total"
+	// время от записи факта в kafka до успешной доставки в API
+	metricResidence = "buffer_residence_seconds"
+	// сообщения переписанные в топик повторов после ошибки доставки
+	metricRetriedMessages = "buffer_retried_messages_total"
+	// нечитаемые сообщения, отправленные в DLQ или пропущенные без повторов
+	metricUndecodableMessages = "buffer_undecodable_messages_total"
+	// сообщения отправленные в DLQ
+	metricDeadLetteredMessages = "buffer_dead_lettered_messages_total"
+	// прочитанные из kafka, помеченные и пропущенные без DLQ сообщения, см. reconciliation
+	metricConsumedMessages = "buffer_consumed_messages_total"
+	metricMarkedMessages   = "buffer_marked_messages_total"
+	metricSkippedMessages  = "buffer_skipped_messages_total"
+	// результаты записи в kafka пришедшие после PRODUCE_TIMEOUT, клиент к этому моменту получил 504
+	metricLateProduceResults = "buffer_late_produce_results_total"
+	// факты которые не удалось продублировать в TARGET_MIRROR_URL
+	metricMirrorFailures = "buffer_mirror_failures_total"
+	// подтверждения доставки, которые не удалось отправить на callback-url
+	metricCallbackFailures = "buffer_callback_failures_total"
+	// факты POST /facts?async=true ожидающие отправки в kafka
+	metricAsyncQueueDepth = "buffer_async_queue_depth"
+	// async факты которые не удалось записать в kafka, клиент о них уже получил 202
+	metricAsyncProduceFailures = "buffer_async_produce_failures_total"
+)
+
+type metricKind int
+
+const (
+	counterMetric metricKind = iota
+	histogramMetric
+	gaugeMetric
+)
+
+type metricDefinition struct {
+	name   string
+	kind   metricKind
+	help   string
+	labels []string
+	// только для гистограмм prometheus
+	buckets []float64
+}
+
+var metricDefinitions = []metricDefinition{
+	{name: metricValidationFailures, kind: counterMetric, help: "Number of /facts validation failures by message field.", labels: []string{"field"}},
+	{name: metricResponseWriteFailures, kind: counterMetric, help: "Number of JSON responses that failed to be written to the client."},
+	{name: metricResidence, kind: histogramMetric, help: "Time from producing a message to Kafka until it is delivered downstream.", labels: []string{"topic"}, buckets: prometheus.ExponentialBuckets(0.01, 2, 16)},
+	{name: metricRetriedMessages, kind: counterMetric, help: "Number of messages re-produced for another delivery attempt.", labels: []string{"topic"}},
+	{name: metricUndecodableMessages, kind: counterMetric, help: "Number of consumed messages that could not be decoded.", labels: []string{"topic"}},
+	{name: metricDeadLetteredMessages, kind: counterMetric, help: "Number of messages sent to the dead-letter topic.", labels: []string{"topic", "partition"}},
+	{name: metricConsumedMessages, kind: counterMetric, help: "Number of messages consumed from Kafka.", labels: []string{"topic", "partition"}},
+	{name: metricMarkedMessages, kind: counterMetric, help: "Number of consumed messages marked as processed.", labels: []string{"topic", "partition"}},
+	{name: metricSkippedMessages, kind: counterMetric, help: "Number of undecodable messages marked without being sent to the dead-letter topic.", labels: []string{"topic", "partition"}},
+	{name: metricLateProduceResults, kind: counterMetric, help: "Number of produce results that arrived after the request timed out, by result.", labels: []string{"result"}},
+	{name: metricMirrorFailures, kind: counterMetric, help: "Number of facts that failed to be mirrored to the secondary downstream."},
+	{name: metricCallbackFailures, kind: counterMetric, help: "Number of delivery callbacks that failed or were skipped."},
+	{name: metricAsyncQueueDepth, kind: gaugeMetric, help: "Number of async /facts messages waiting to be produced to Kafka."},
+	{name: metricAsyncProduceFailures, kind: counterMetric, help: "Number of async /facts messages that failed to be produced to Kafka."},
+}
+
+// Metrics принимает значения метрик. Значения меток передаются в порядке labels из metricDefinitions
+type Metrics interface {
+	// Inc увеличивает счетчик на единицу
+	Inc(name string, labels ...string)
+	// Observe записывает значение в гистограмму
+	Observe(name string, value float64, labels ...string)
+	// Gauge устанавливает текущее значение
+	Gauge(name string, value float64, labels ...string)
+}
+
+// metrics — выбранный в METRICS_BACKEND приемник, задается в main до запуска компонентов
+var metrics Metrics = noopMetrics{}
+
+// newMetrics возвращает приемник метрик выбранный через METRICS_BACKEND
+func newMetrics(cfg Config) (Metrics, error) {
+	switch cfg.MetricsBackend {
+	case "statsd":
+		return newStatsdMetrics(cfg.StatsdAddr, cfg.StatsdPrefix)
+	case "none":
+		return noopMetrics{}, nil
+	default:
+		return newPrometheusMetrics(prometheus.DefaultRegisterer), nil
+	}
+}
+
+// prometheusMetrics регистрирует метрики в registerer, отдаются через /metrics
+type prometheusMetrics struct {
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+	gauges     map[string]*prometheus.GaugeVec
+}
+
+func newPrometheusMetrics(registerer prometheus.Registerer) *prometheusMetrics {
+	factory := promauto.With(registerer)
+	m := &prometheusMetrics{
+		counters:   make(map[string]*prometheus.CounterVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
+	}
+	for _, def := range metricDefinitions {
+		switch def.kind {
+		case counterMetric:
+			m.counters[def.name] = factory.NewCounterVec(prometheus.CounterOpts{Name: def.name, Help: def.help}, def.labels)
+		case histogramMetric:
+			m.histograms[def.name] = factory.NewHistogramVec(prometheus.HistogramOpts{Name: def.name, Help: def.help, Buckets: def.buckets}, def.labels)
+		case gaugeMetric:
+			m.gauges[def.name] = factory.NewGaugeVec(prometheus.GaugeOpts{Name: def.name, Help: def.help}, def.labels)
+		}
+	}
+	return m
+}
+
+func (m *prometheusMetrics) Inc(name string, labels ...string) {
+	m.counters[name].WithLabelValues(labels...).Inc()
+}
+
+func (m *prometheusMetrics) Observe(name string, value float64, labels ...string) {
+	m.histograms[name].WithLabelValues(labels...).Observe(value)
+}
+
+func (m *prometheusMetrics) Gauge(name string, value float64, labels ...string) {
+	m.gauges[name].WithLabelValues(labels...).Set(value)
+}
+
+// statsdMetrics отправляет метрики по UDP в формате DogStatsD, метки передаются тегами.
+// Отправка не блокирует и не сообщает об ошибках: потеря пакета метрик допустима
+type statsdMetrics struct {
+	conn   net.Conn
+	prefix string
+	labels map[string][]string
+}
+
+func newStatsdMetrics(addr, prefix string) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to statsd: %w", err)
+	}
+	m := &statsdMetrics{conn: conn, prefix: prefix, labels: make(map[string][]string)}
+	for _, def := range metricDefinitions {
+		m.labels[def.name] = def.labels
+	}
+	return m, nil
+}
+
+func (m *statsdMetrics) Inc(name string, labels ...string) {
+	m.send(name, "1", "c", labels)
+}
+
+func (m *statsdMetrics) Observe(name string, value float64, labels ...string) {
+	m.send(name, strconv.FormatFloat(value, 'f', -1, 64), "h", labels)
+}
+
+func (m *statsdMetrics) Gauge(name string, value float64, labels ...string) {
+	m.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", labels)
+}
+
+func (m *statsdMetrics) send(name, value, kind string, labels []string) {
+	line := m.prefix + name + ":" + value + "|" + kind
+	tags := make([]string, 0, len(labels))
+	for i, label := range m.labels[name] {
+		if i < len(labels) {
+			tags = append(tags, label+":"+labels[i])
+		}
+	}
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	m.conn.Write([]byte(line))
+}
+
+// noopMetrics отбрасывает все значения, METRICS_BACKEND=none
+type noopMetrics struct{}
+
+func (noopMetrics) Inc(string, ...string)              {}
+func (noopMetrics) Observe(string, float64, ...string) {}
+func (noopMetrics) Gauge(string, float64, ...string)   {}
+
+// имена полей Message в json, только они допустимы как значения метки field
+var messageFieldNames = jsonFieldNames(reflect.TypeOf(Message{}))
+
+// isMessageField проверяет что name — имя поля Message в json
+func isMessageField(name string) bool {
+	for _, field := range messageFieldNames {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFieldNames возвращает соответствие имени поля структуры его имени в json теге
+func jsonFieldNames(t reflect.Type) map[string]string {
+	names := make(map[string]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		names[field.Name] = name
+	}
+	return names
+}
+
+// observeValidationErrors увеличивает счетчик для каждого поля не прошедшего валидацию.
+// Метка ограничена известными полями Message, остальное попадает в "unknown",
+// чтобы число временных рядов не росло от входящих данных
+func observeValidationErrors(err error) {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		metrics.Inc(metricValidationFailures, "unknown")
+		return
+	}
+	for _, fieldError := range validationErrors {
+		field, ok := messageFieldNames[fieldError.StructField()]
+		if !ok {
+			field = "unknown"
+		}
+		metrics.Inc(metricValidationFailures, field)
+	}
+}
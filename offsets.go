@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// offsetMarker помечает и коммитит смещения: сессия consumer group или partitionOffsets
+// в режиме CONSUME_PARTITIONS
+type offsetMarker interface {
+	MarkMessage(message *sarama.ConsumerMessage, metadata string)
+	Commit()
+}
+
+// offsetCommitter помечает сообщения партиции и, если включены ручные коммиты
+// (batchSize > 0), коммитит их каждые batchSize пометок или раз в interval.
+// Без ручных коммитов помеченные смещения коммитит sarama раз в interval
+type offsetCommitter struct {
+	session   offsetMarker
+	counts    *reconciliation
+	batchSize int
+	pending   int
+	ticker    *time.Ticker
+}
+
+func newOffsetCommitter(session offsetMarker, counts *reconciliation, batchSize int, interval time.Duration) *offsetCommitter {
+	committer := &offsetCommitter{session: session, counts: counts, batchSize: batchSize}
+	if batchSize > 0 {
+		committer.ticker = time.NewTicker(interval)
+	}
+	return committer
+}
+
+// mark помечает сообщение обработанным и коммитит пачку, если она набралась
+func (c *offsetCommitter) mark(message *sarama.ConsumerMessage) {
+	c.session.MarkMessage(message, "")
+	c.counts.marked(message)
+	if c.batchSize <= 0 {
+		return
+	}
+	c.pending++
+	if c.pending >= c.batchSize {
+		c.commit()
+	}
+}
+
+// tick срабатывает раз в commitInterval в режиме ручных коммитов, иначе никогда
+func (c *offsetCommitter) tick() <-chan time.Time {
+	if c.ticker == nil {
+		return nil
+	}
+	return c.ticker.C
+}
+
+// commit синхронно коммитит помеченные смещения если есть что коммитить
+func (c *offsetCommitter) commit() {
+	if c.pending == 0 {
+		return
+	}
+	c.session.Commit()
+	c.pending = 0
+}
+
+// close коммитит остаток при завершении обработки партиции, чтобы не потерять прогресс
+func (c *offsetCommitter) close() {
+	if c.ticker == nil {
+		return
+	}
+	c.ticker.Stop()
+	if c.pending > 0 {
+		log.Printf("Committing %d marked messages on claim exit\n", c.pending)
+		c.commit()
+	}
+}
+
+// partitionOffsets хранит смещения одной партиции в KAFKA_GROUP без участия в группе
+type partitionOffsets struct {
+	manager   sarama.OffsetManager
+	partition sarama.PartitionOffsetManager
+}
+
+func (o partitionOffsets) MarkMessage(message *sarama.ConsumerMessage, metadata string) {
+	o.partition.MarkOffset(message.Offset+1, metadata)
+}
+
+func (o partitionOffsets) Commit() {
+	o.manager.Commit()
+}
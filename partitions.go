@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// startPartitionConsumer читает партиции CONSUME_PARTITIONS единственного топика без consumer group:
+// ребалансировки нет, экземпляр читает ровно заданные партиции. Смещения хранятся в KAFKA_GROUP,
+// поэтому после перезапуска чтение продолжается с последнего коммита
+func startPartitionConsumer(ctx context.Context, cfg Config, config *sarama.Config, consumer *Consumer) error {
+	client, err := sarama.NewClient(cfg.Brokers, config)
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	defer client.Close()
+	if err := checkTopicsExist(cfg, config); err != nil {
+		return fmt.Errorf("checking topics: %w", err)
+	}
+
+	offsetManager, err := sarama.NewOffsetManagerFromClient(cfg.Group, client)
+	if err != nil {
+		return fmt.Errorf("creating offset manager: %w", err)
+	}
+	// закрывается перед клиентом и коммитит помеченные смещения
+	defer offsetManager.Close()
+	partitionConsumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return fmt.Errorf("creating consumer: %w", err)
+	}
+	defer partitionConsumer.Close()
+
+	topic := cfg.Topics[0]
+	wg := &sync.WaitGroup{}
+	for _, partition := range cfg.ConsumePartitions {
+		offsets, err := offsetManager.ManagePartition(topic, partition)
+		if err != nil {
+			return fmt.Errorf("managing offsets of %s/%d: %w", topic, partition, err)
+		}
+		defer offsets.Close()
+
+		messages, err := consumePartitionFrom(partitionConsumer, topic, partition, offsets, config.Consumer.Offsets.Initial)
+		if err != nil {
+			return err
+		}
+		defer messages.Close()
+
+		log.Printf("Consuming %s/%d without consumer group\n", topic, partition)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer consumer.reconciliation.logPartition(topic, partition)
+			consumer.consumePartition(ctx, messages.Messages(), partitionOffsets{manager: offsetManager, partition: offsets})
+		}()
+	}
+
+	consumerReady.Store(true)
+	defer consumerReady.Store(false)
+	wg.Wait()
+	return nil
+}
+
+// consumePartitionFrom начинает чтение с закоммиченного смещения, а если его уже нет в партиции
+// (удалено по retention) — с начального смещения, как это делает consumer group
+func consumePartitionFrom(partitionConsumer sarama.Consumer, topic string, partition int32, offsets sarama.PartitionOffsetManager, initial int64) (sarama.PartitionConsumer, error) {
+	next, _ := offsets.NextOffset()
+	messages, err := partitionConsumer.ConsumePartition(topic, partition, next)
+	if errors.Is(err, sarama.ErrOffsetOutOfRange) {
+		log.Printf("Committed offset %d of %s/%d is out of range, resetting\n", next, topic, partition)
+		messages, err = partitionConsumer.ConsumePartition(topic, partition, initial)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("consuming %s/%d: %w", topic, partition, err)
+	}
+	return messages, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionCounts — сколько сообщений партиции прочитано и что с ними стало с запуска процесса
+type partitionCounts struct {
+	consumed     int64
+	marked       int64
+	deadLettered int64
+	skipped      int64
+}
+
+// reconciliation считает прочитанные, помеченные, отправленные в DLQ и пропущенные сообщения
+// по партициям, чтобы сверять их в логе и метриках и замечать сообщения пропавшие без следа
+type reconciliation struct {
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionCounts
+}
+
+func newReconciliation() *reconciliation {
+	return &reconciliation{partitions: make(map[topicPartition]*partitionCounts)}
+}
+
+func (r *reconciliation) add(message *sarama.ConsumerMessage, metric string, count func(*partitionCounts)) {
+	metrics.Inc(metric, message.Topic, strconv.Itoa(int(message.Partition)))
+	key := topicPartition{topic: message.Topic, partition: message.Partition}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts, ok := r.partitions[key]
+	if !ok {
+		counts = &partitionCounts{}
+		r.partitions[key] = counts
+	}
+	count(counts)
+}
+
+func (r *reconciliation) consumed(message *sarama.ConsumerMessage) {
+	r.add(message, metricConsumedMessages, func(c *partitionCounts) { c.consumed++ })
+}
+
+func (r *reconciliation) marked(message *sarama.ConsumerMessage) {
+	r.add(message, metricMarkedMessages, func(c *partitionCounts) { c.marked++ })
+}
+
+func (r *reconciliation) deadLettered(message *sarama.ConsumerMessage) {
+	r.add(message, metricDeadLetteredMessages, func(c *partitionCounts) { c.deadLettered++ })
+}
+
+// skipped — нечитаемое сообщение помечено без DLQ, см. skipUndecodable
+func (r *reconciliation) skipped(message *sarama.ConsumerMessage) {
+	r.add(message, metricSkippedMessages, func(c *partitionCounts) { c.skipped++ })
+}
+
+// logPartition пишет счетчики одной партиции, например когда ее обработка завершается
+func (r *reconciliation) logPartition(topic string, partition int32) {
+	r.mu.Lock()
+	counts, ok := r.partitions[topicPartition{topic: topic, partition: partition}]
+	var snapshot partitionCounts
+	if ok {
+		snapshot = *counts
+	}
+	r.mu.Unlock()
+	logPartitionCounts(topic, partition, snapshot)
+}
+
+// run раз в interval пишет счетчики всех партиций, по которым были сообщения
+func (r *reconciliation) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			keys := make([]topicPartition, 0, len(r.partitions))
+			snapshots := make(map[topicPartition]partitionCounts, len(r.partitions))
+			for key, counts := range r.partitions {
+				keys = append(keys, key)
+				snapshots[key] = *counts
+			}
+			r.mu.Unlock()
+
+			slices.SortFunc(keys, func(a, b topicPartition) int {
+				return cmp.Or(cmp.Compare(a.topic, b.topic), cmp.Compare(a.partition, b.partition))
+			})
+			for _, key := range keys {
+				logPartitionCounts(key.topic, key.partition, snapshots[key])
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logPartitionCounts пишет строку сверки партиции. В at-least-once помечаются доставленные,
+// записанные на повтор, отправленные в DLQ и пропущенные сообщения, поэтому consumed больше
+// marked только на сообщения в обработке, включая повторяемые на месте
+func logPartitionCounts(topic string, partition int32, counts partitionCounts) {
+	log.Printf("reconciliation %s/%d: consumed=%d marked=%d dlq=%d skipped=%d\n",
+		topic, partition, counts.consumed, counts.marked, counts.deadLettered, counts.skipped)
+}
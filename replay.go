@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/IBM/sarama"
+)
+
+// replayRequest — диапазон смещений [From, To] одной партиции для повторной отправки
+type replayRequest struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	From      int64  `json:"from"`
+	To        int64  `json:"to"`
+}
+
+type replayFailure struct {
+	Offset int64  `json:"offset"`
+	Error  string `json:"error"`
+}
+
+type replayResult struct {
+	replayRequest
+	Delivered int             `json:"delivered"`
+	Failed    int             `json:"failed"`
+	Failures  []replayFailure `json:"failures"`
+}
+
+// replayRangeError — запрошенный диапазон некорректен или вне доступных смещений партиции
+type replayRangeError struct {
+	reason string
+}
+
+func (e *replayRangeError) Error() string {
+	return "invalid replay range: " + e.reason
+}
+
+// ошибок в ответе не больше, чтобы большой диапазон с упавшим API не раздувал ответ
+const maxReplayFailures = 100
+
+// replayRange читает диапазон смещений партиции отдельным consumer (не в группе, смещения
+// группы не меняются) и отправляет каждое сообщение через sink. Повторы и DLQ не используются:
+// результат по каждому сообщению возвращается в ответе
+func replayRange(ctx context.Context, cfg Config, config *sarama.Config, consumer *Consumer, request replayRequest) (*replayResult, error) {
+	if request.From < 0 || request.To < request.From {
+		return nil, &replayRangeError{reason: fmt.Sprintf("expected 0 <= from <= to, got %d..%d", request.From, request.To)}
+	}
+	if count := request.To - request.From + 1; count > int64(cfg.ReplayMaxMessages) {
+		return nil, &replayRangeError{reason: fmt.Sprintf("%d messages requested, at most %d allowed", count, cfg.ReplayMaxMessages)}
+	}
+
+	client, err := sarama.NewClient(cfg.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	// проверяем что диапазон еще хранится в партиции, иначе ConsumePartition вернет ошибку
+	// или будет ждать новых сообщений бесконечно
+	oldest, err := client.GetOffset(request.Topic, request.Partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, &replayRangeError{reason: fmt.Sprintf("partition %s/%d: %v", request.Topic, request.Partition, err)}
+	}
+	newest, err := client.GetOffset(request.Topic, request.Partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, err
+	}
+	if request.From < oldest || request.To >= newest {
+		return nil, &replayRangeError{reason: fmt.Sprintf("available offsets are %d..%d", oldest, newest-1)}
+	}
+
+	partitionConsumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer partitionConsumer.Close()
+	messages, err := partitionConsumer.ConsumePartition(request.Topic, request.Partition, request.From)
+	if err != nil {
+		return nil, err
+	}
+	defer messages.Close()
+
+	log.Printf("Replaying %s/%d offsets %d..%d\n", request.Topic, request.Partition, request.From, request.To)
+	result := &replayResult{replayRequest: request, Failures: []replayFailure{}}
+	for {
+		select {
+		case message := <-messages.Messages():
+			if message.Offset > request.To {
+				return result, nil
+			}
+			if err := consumer.deliver(ctx, message); err != nil {
+				result.Failed++
+				if len(result.Failures) < maxReplayFailures {
+					result.Failures = append(result.Failures, replayFailure{Offset: message.Offset, Error: err.Error()})
+				}
+			} else {
+				result.Delivered++
+			}
+			if message.Offset == request.To {
+				return result, nil
+			}
+		case err := <-messages.Errors():
+			return nil, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
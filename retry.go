@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Заголовки сообщений для повторной доставки.
+// delivery-attempts пишется при каждой повторной записи сообщения в kafka и читается consumer
+// при ошибке доставки, поэтому счетчик попыток не сбрасывается при перезапуске и общий для всех
+// экземпляров сервиса. Остальные заголовки добавляются в DLQ для разбора
+const (
+	deliveryAttemptsHeaderKey  = "delivery-attempts"
+	deadLetterReasonHeaderKey  = "dlq-reason"
+	originalTopicHeaderKey     = "original-topic"
+	originalPartitionHeaderKey = "original-partition"
+	originalOffsetHeaderKey    = "original-offset"
+)
+
+// deliveryAttempts возвращает сколько раз сообщение уже не удалось доставить
+func deliveryAttempts(message *sarama.ConsumerMessage) int {
+	for _, header := range message.Headers {
+		if string(header.Key) != deliveryAttemptsHeaderKey {
+			continue
+		}
+		attempts, err := strconv.Atoi(string(header.Value))
+		if err != nil || attempts < 0 {
+			return 0
+		}
+		return attempts
+	}
+	return 0
+}
+
+// retryLater переписывает недоставленное сообщение в топик повторов с увеличенным
+// delivery-attempts, а после MAX_DELIVERY_ATTEMPTS попыток или при окончательном отказе API —
+// в DLQ. Возвращает true если сообщение записано и исходное можно пометить. Без
+// MAX_DELIVERY_ATTEMPTS сообщение просто остается непомеченным, как и раньше
+func (consumer *Consumer) retryLater(ctx context.Context, message *sarama.ConsumerMessage, cause error) bool {
+	if consumer.cfg.MaxDeliveryAttempts <= 0 || consumer.cfg.DeliverySemantics != deliveryAtLeastOnce {
+		return false
+	}
+
+	attempts := deliveryAttempts(message) + 1
+	if attempts >= consumer.cfg.MaxDeliveryAttempts || !consumer.retryable(cause) {
+		return consumer.deadLetter(message, attempts, cause.Error())
+	}
+
+	// пауза перед повтором, чтобы не добивать перегруженный API. Прерванное остановкой
+	// сообщение остается непомеченным и будет прочитано заново
+	if backoff := consumer.retryBackoff(attempts); backoff > 0 {
+		timer := time.NewTimer(backoff)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	topic := consumer.cfg.RetryTopic
+	if topic == "" {
+		topic = message.Topic
+	}
+	if err := consumer.reproduce(topic, message, attempts, nil); err != nil {
+		log.Printf("Error producing message %s/%d/%d for retry: %v\n", message.Topic, message.Partition, message.Offset, err)
+		return false
+	}
+	metrics.Inc(metricRetriedMessages, message.Topic)
+	return true
+}
+
+// retryable сообщает, может ли повтор исправить ошибку доставки. Ответ API с кодом не из
+// RETRYABLE_STATUS_CODES — окончательный отказ (например 400 на некорректный факт), ошибки
+// соединения и таймауты — временные
+func (consumer *Consumer) retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return slices.Contains(consumer.cfg.RetryableStatusCodes, status.StatusCode)
+	}
+	return true
+}
+
+// retryBackoff возвращает паузу перед attempts-й повторной доставкой: RETRY_BACKOFF,
+// удваивающийся с каждой попыткой, но не больше RETRY_BACKOFF_MAX
+func (consumer *Consumer) retryBackoff(attempts int) time.Duration {
+	backoff := consumer.cfg.RetryBackoff
+	for i := 1; i < attempts && backoff < consumer.cfg.RetryBackoffMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, consumer.cfg.RetryBackoffMax)
+}
+
+// skipUndecodable убирает нечитаемое сообщение с пути партиции: повтор его не исправит, а
+// непомеченное оно читалось бы снова и снова. Сообщение уходит в DLQ сразу, без повторов,
+// а без KAFKA_DLQ_TOPIC пропускается. Факт, не прошедший валидацию, без DLQ не пропускается
+// и повторяется на месте, как недоставленное. Возвращает true если сообщение можно пометить
+func (consumer *Consumer) skipUndecodable(message *sarama.ConsumerMessage, cause error) bool {
+	metrics.Inc(metricUndecodableMessages, message.Topic)
+	if consumer.cfg.DeadLetterTopic == "" && errors.Is(cause, errInvalidFact) {
+		log.Printf("message %s/%d/%d not marked: invalid fact and KAFKA_DLQ_TOPIC is not set\n", message.Topic, message.Partition, message.Offset)
+		return false
+	}
+	if consumer.cfg.DeadLetterTopic == "" {
+		log.Printf("message %s/%d/%d skipped: undecodable and KAFKA_DLQ_TOPIC is not set\n", message.Topic, message.Partition, message.Offset)
+		consumer.reconciliation.skipped(message)
+		return true
+	}
+	return consumer.deadLetter(message, deliveryAttempts(message)+1, cause.Error())
+}
+
+// deadLetter записывает сообщение в DLQ с причиной и координатами исходного сообщения
+func (consumer *Consumer) deadLetter(message *sarama.ConsumerMessage, attempts int, reason string) bool {
+	if consumer.cfg.DeadLetterTopic == "" {
+		return false
+	}
+	extra := []sarama.RecordHeader{
+		{Key: []byte(deadLetterReasonHeaderKey), Value: []byte(reason)},
+		{Key: []byte(originalTopicHeaderKey), Value: []byte(message.Topic)},
+		{Key: []byte(originalPartitionHeaderKey), Value: []byte(strconv.Itoa(int(message.Partition)))},
+		{Key: []byte(originalOffsetHeaderKey), Value: []byte(strconv.FormatInt(message.Offset, 10))},
+	}
+	if err := consumer.reproduce(consumer.cfg.DeadLetterTopic, message, attempts, extra); err != nil {
+		log.Printf("Error producing message %s/%d/%d to DLQ: %v\n", message.Topic, message.Partition, message.Offset, err)
+		return false
+	}
+	log.Printf("message %s/%d/%d sent to DLQ after %d attempts: %s\n", message.Topic, message.Partition, message.Offset, attempts, reason)
+	consumer.reconciliation.deadLettered(message)
+	return true
+}
+
+// reproduce записывает копию сообщения в topic, сохраняя ключ, значение и заголовки,
+// и выставляет delivery-attempts в attempts
+func (consumer *Consumer) reproduce(topic string, message *sarama.ConsumerMessage, attempts int, extra []sarama.RecordHeader) error {
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+len(extra)+1)
+	for _, header := range message.Headers {
+		if header == nil || string(header.Key) == deliveryAttemptsHeaderKey {
+			continue
+		}
+		headers = append(headers, *header)
+	}
+	headers = append(headers, sarama.RecordHeader{
+		Key:   []byte(deliveryAttemptsHeaderKey),
+		Value: []byte(strconv.Itoa(attempts)),
+	})
+	headers = append(headers, extra...)
+
+	// партицию выбирает producer по ключу, см. startFailuresProducer
+	msg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Headers: headers,
+	}
+	if message.Key != nil {
+		msg.Key = sarama.ByteEncoder(message.Key)
+	}
+	// null значение tombstone должно остаться null
+	if message.Value != nil {
+		msg.Value = sarama.ByteEncoder(message.Value)
+	}
+	_, _, err := consumer.producer.SendMessage(msg)
+	return err
+}
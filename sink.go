@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Sink доставляет прочитанное из kafka сообщение получателю.
+// Ошибка означает что сообщение не доставлено и в режиме at-least-once не будет помечено
+type Sink interface {
+	Deliver(ctx context.Context, message Message) error
+	// Delete отзывает ранее доставленный факт по indicator_to_mo_fact_id
+	Delete(ctx context.Context, factID int) error
+}
+
+// statusError — API ответил, но не подтвердил доставку: код не из SUCCESS_STATUS_CODES
+// или TARGET_SUCCESS_FIELD не совпал. По коду решается, есть ли смысл повторять
+type statusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("downstream rejected request: status %d, body %s", e.StatusCode, e.Body)
+}
+
+// newSink возвращает получателя выбранного через SINK
+func newSink(cfg Config) (Sink, error) {
+	switch cfg.Sink {
+	case "noop":
+		return NoopSink{}, nil
+	default:
+		transport, err := newTargetTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		roundTripper, token := newTargetAuth(cfg, transport)
+		sink := NewHTTPSink(cfg.TargetURL, cfg.TargetMethod, token)
+		sink.Client.Transport = roundTripper
+		sink.Client.Timeout = cfg.TargetTotalTimeout
+		sink.DeleteURL = cfg.TargetDeleteURL
+		sink.FieldKeys = cfg.TargetFieldMapping
+		sink.SuccessStatusCodes = cfg.SuccessStatusCodes
+		sink.SuccessField = cfg.SuccessField
+		sink.SuccessValue = cfg.SuccessValue
+		sink.BatchURL = cfg.TargetBatchURL
+		sink.OmitZeroFactID = cfg.TargetOmitZeroFactID
+		if cfg.TargetMirrorURL == "" {
+			return sink, nil
+		}
+
+		return newMirrorSink(sink, newMirrorHTTPSink(cfg, transport)), nil
+	}
+}
+
+// newMirrorHTTPSink возвращает sink зеркала TARGET_MIRROR_URL. Зеркало — другой backend:
+// токен и OAuth2 основного API ему не передаются, только TARGET_MIRROR_TOKEN, а факты
+// отправляются POST независимо от TARGET_HTTP_METHOD
+func newMirrorHTTPSink(cfg Config, transport http.RoundTripper) *HTTPSink {
+	mirror := NewHTTPSink(cfg.TargetMirrorURL, http.MethodPost, cfg.TargetMirrorToken)
+	mirror.Client.Transport = transport
+	mirror.Client.Timeout = cfg.TargetTotalTimeout
+	mirror.FieldKeys = cfg.TargetFieldMapping
+	mirror.OmitZeroFactID = cfg.TargetOmitZeroFactID
+	// формат ответа зеркала может отличаться, поэтому проверяем только код
+	mirror.SuccessStatusCodes = []int{http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent}
+	mirror.SuccessField = ""
+	return mirror
+}
+
+// HTTPSink отправляет факт формой в KPI API
+type HTTPSink struct {
+	URL    string
+	Method string
+	Token  string
+	Client *http.Client
+	// адрес API удаления факта для tombstone сообщений
+	DeleteURL string
+	// адрес API пакетного сохранения фактов
+	BatchURL string
+	// не передавать indicator_to_mo_fact_id равный 0
+	OmitZeroFactID bool
+	// имя поля сообщения -> ключ формы в API, поля без записи отправляются под своим именем
+	FieldKeys map[string]string
+	// коды ответа API которые считаются успешной доставкой
+	SuccessStatusCodes []int
+	// если задано, поле json ответа должно быть равно SuccessValue
+	SuccessField string
+	SuccessValue string
+}
+
+func NewHTTPSink(url, method, token string) *HTTPSink {
+	return &HTTPSink{
+		URL:                url,
+		Method:             method,
+		Token:              token,
+		Client:             &http.Client{Timeout: 10 * time.Second},
+		SuccessStatusCodes: []int{http.StatusOK},
+		SuccessField:       "STATUS",
+		SuccessValue:       "OK",
+	}
+}
+
+// newTargetTransport возвращает транспорт для запросов в API. Прокси берется из TARGET_PROXY_URL,
+// а если он не задан — из HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+func newTargetTransport(cfg Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// общий таймаут задается на клиенте, здесь только отдельные этапы запроса
+	transport.DialContext = (&net.Dialer{
+		Timeout:   cfg.TargetConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = cfg.TargetResponseHeaderTimeout
+	transport.Proxy = http.ProxyFromEnvironment
+	if cfg.TargetProxyURL != nil {
+		transport.Proxy = http.ProxyURL(cfg.TargetProxyURL)
+	}
+
+	tlsConfig, err := newTargetTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport, nil
+}
+
+// newTargetAuth возвращает транспорт и статический токен для запросов в API. С TARGET_OAUTH_TOKEN_URL
+// токен получается по OAuth2 client credentials и обновляется до истечения, а статический
+// TARGET_TOKEN не используется
+func newTargetAuth(cfg Config, transport *http.Transport) (http.RoundTripper, string) {
+	if cfg.TargetOAuthTokenURL == "" {
+		return transport, cfg.TargetToken
+	}
+
+	credentials := &clientcredentials.Config{
+		ClientID:     cfg.TargetOAuthClientID,
+		ClientSecret: cfg.TargetOAuthClientSecret,
+		TokenURL:     cfg.TargetOAuthTokenURL,
+		Scopes:       cfg.TargetOAuthScopes,
+	}
+	// токен запрашивается через тот же прокси и TLS что и само API
+	tokenClient := &http.Client{Transport: transport, Timeout: cfg.TargetTotalTimeout}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, tokenClient)
+	return &oauth2.Transport{Source: credentials.TokenSource(ctx), Base: transport}, ""
+}
+
+// newTargetTLSConfig собирает tls.Config с клиентским сертификатом и CA для API.
+// Возвращает nil если ни сертификат, ни CA не заданы и нужен TLS по умолчанию
+func newTargetTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TargetClientCert == "" && cfg.TargetCACert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TargetClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TargetClientCert, cfg.TargetClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TargetCACert != "" {
+		pem, err := os.ReadFile(cfg.TargetCACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TargetCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func (sink *HTTPSink) Deliver(ctx context.Context, data Message) error {
+	// Формируем данные для отправки в формате form-data
+	formData := url.Values{}
+	formData.Set(sink.formKey("period_start"), data.PeriodStart)
+	formData.Set(sink.formKey("period_end"), data.PeriodEnd)
+	formData.Set(sink.formKey("period_key"), data.PeriodKey)
+	formData.Set(sink.formKey("indicator_to_mo_id"), strconv.Itoa(data.IndicatorToMoID))
+	// 0 API может понять как обновление существующего факта, а не создание нового
+	if data.IndicatorToMoFactID != 0 || !sink.OmitZeroFactID {
+		formData.Set(sink.formKey("indicator_to_mo_fact_id"), strconv.Itoa(data.IndicatorToMoFactID))
+	}
+	formData.Set(sink.formKey("value"), strconv.Itoa(data.Value))
+	formData.Set(sink.formKey("fact_time"), data.FactTime)
+	formData.Set(sink.formKey("is_plan"), strconv.Itoa(data.IsPlan))
+	formData.Set(sink.formKey("auth_user_id"), strconv.Itoa(data.AuthUserID))
+	formData.Set(sink.formKey("comment"), data.Comment)
+
+	return sink.send(ctx, sink.URL, formData)
+}
+
+// DeliverBatch отправляет факты json массивом объектов с теми же ключами что и в форме
+func (sink *HTTPSink) DeliverBatch(ctx context.Context, messages []Message) error {
+	if sink.BatchURL == "" {
+		return fmt.Errorf("TARGET_BATCH_URL is not configured")
+	}
+	batch := make([]map[string]any, 0, len(messages))
+	for _, message := range messages {
+		messageBytes, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(messageBytes, &fields); err != nil {
+			return err
+		}
+		if message.IndicatorToMoFactID == 0 && sink.OmitZeroFactID {
+			delete(fields, "indicator_to_mo_fact_id")
+		}
+		item := make(map[string]any, len(fields))
+		for field, value := range fields {
+			item[sink.formKey(field)] = value
+		}
+		batch = append(batch, item)
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return sink.do(ctx, sink.BatchURL, "application/json", bytes.NewReader(body))
+}
+
+func (sink *HTTPSink) Delete(ctx context.Context, factID int) error {
+	if sink.DeleteURL == "" {
+		return fmt.Errorf("TARGET_DELETE_URL is not configured")
+	}
+	formData := url.Values{}
+	formData.Set(sink.formKey("indicator_to_mo_fact_id"), strconv.Itoa(factID))
+	return sink.send(ctx, sink.DeleteURL, formData)
+}
+
+// send отправляет форму в API и проверяет что API подтвердил сохранение
+func (sink *HTTPSink) send(ctx context.Context, target string, formData url.Values) error {
+	return sink.do(ctx, target, "application/x-www-form-urlencoded", strings.NewReader(formData.Encode()))
+}
+
+func (sink *HTTPSink) do(ctx context.Context, target, contentType string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, sink.Method, target, body)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	// без статического токена заголовок ставит транспорт OAuth2
+	if sink.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+sink.Token)
+	}
+
+	// Отправляем запрос
+	resp, err := sink.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading response body: %w", err)
+	}
+	recordDownstreamResult(ctx, resp.StatusCode, responseBody)
+
+	if !slices.Contains(sink.SuccessStatusCodes, resp.StatusCode) {
+		return &statusError{StatusCode: resp.StatusCode, Body: responseBody}
+	}
+	// некоторые API отвечают 200 с ошибкой в теле, поэтому дополнительно проверяем поле ответа
+	if sink.SuccessField == "" {
+		return nil
+	}
+	var responseMap map[string]interface{}
+	if err := json.Unmarshal(responseBody, &responseMap); err != nil {
+		return fmt.Errorf("unmarshaling response body: %w", err)
+	}
+	if value, ok := responseMap[sink.SuccessField]; !ok || fmt.Sprint(value) != sink.SuccessValue {
+		return &statusError{StatusCode: resp.StatusCode, Body: responseBody}
+	}
+	return nil
+}
+
+// formKey возвращает ключ формы API для поля сообщения
+func (sink *HTTPSink) formKey(field string) string {
+	if key, ok := sink.FieldKeys[field]; ok {
+		return key
+	}
+	return field
+}
+
+// parseFieldMapping разбирает TARGET_FIELD_MAPPING вида "period_key=period,comment=note"
+func parseFieldMapping(spec string) (map[string]string, error) {
+	known := make(map[string]bool, len(messageFieldNames))
+	for _, name := range messageFieldNames {
+		known[name] = true
+	}
+
+	mapping := make(map[string]string)
+	used := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		field, key, ok := strings.Cut(pair, "=")
+		field, key = strings.TrimSpace(field), strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected field=key, got %q", pair)
+		}
+		if !known[field] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		mapping[field] = key
+	}
+
+	// два поля под одним ключом молча перезаписали бы друг друга в форме
+	for name := range known {
+		key := name
+		if mapped, ok := mapping[name]; ok {
+			key = mapped
+		}
+		if other, ok := used[key]; ok {
+			return nil, fmt.Errorf("fields %q and %q map to the same key %q", other, name, key)
+		}
+		used[key] = name
+	}
+	return mapping, nil
+}
+
+// зеркальных отправок одновременно, сверх этого они пропускаются чтобы не копить горутины
+const maxMirrorInFlight = 100
+
+// MirrorSink доставляет сообщение в основной sink и после успеха в фоне дублирует его в зеркало.
+// Результат определяется только основным sink, ошибки зеркала логируются и считаются в метрике
+type MirrorSink struct {
+	Primary Sink
+	Mirror  Sink
+
+	inFlight chan struct{}
+	timeout  time.Duration
+}
+
+func newMirrorSink(primary, mirror Sink) *MirrorSink {
+	return &MirrorSink{
+		Primary:  primary,
+		Mirror:   mirror,
+		inFlight: make(chan struct{}, maxMirrorInFlight),
+		timeout:  30 * time.Second,
+	}
+}
+
+// Deliver дублирует факт в зеркало только после успешной доставки в основной sink, иначе
+// при повторах зеркало получало бы факт на каждую попытку
+func (sink *MirrorSink) Deliver(ctx context.Context, data Message) error {
+	if err := sink.Primary.Deliver(ctx, data); err != nil {
+		return err
+	}
+	sink.mirror(data)
+	return nil
+}
+
+// mirror в фоне отправляет факт в зеркало
+func (sink *MirrorSink) mirror(data Message) {
+	select {
+	case sink.inFlight <- struct{}{}:
+		go func() {
+			defer func() { <-sink.inFlight }()
+			// контекст основной доставки отменяется раньше, зеркало не должно от него зависеть
+			mirrorCtx, cancel := context.WithTimeout(context.Background(), sink.timeout)
+			defer cancel()
+			if err := sink.Mirror.Deliver(mirrorCtx, data); err != nil {
+				metrics.Inc(metricMirrorFailures)
+				log.Printf("Error mirroring fact %d: %v\n", data.IndicatorToMoFactID, err)
+			}
+		}()
+	default:
+		metrics.Inc(metricMirrorFailures)
+		log.Printf("Mirror is saturated, skipping fact %d\n", data.IndicatorToMoFactID)
+	}
+}
+
+// DeliverBatch отправляет пачку в основной sink и после успеха дублирует факты в зеркало
+// по одному. Если пачка не принята, факты дублируются при отправке по одному через Deliver
+func (sink *MirrorSink) DeliverBatch(ctx context.Context, messages []Message) error {
+	primary, ok := sink.Primary.(BatchSink)
+	if !ok {
+		return fmt.Errorf("primary sink does not support batches")
+	}
+	if err := primary.DeliverBatch(ctx, messages); err != nil {
+		return err
+	}
+	for _, message := range messages {
+		sink.mirror(message)
+	}
+	return nil
+}
+
+// Delete отправляется только в основной sink: у зеркала нет API удаления
+func (sink *MirrorSink) Delete(ctx context.Context, factID int) error {
+	return sink.Primary.Delete(ctx, factID)
+}
+
+// NoopSink ничего не отправляет и считает каждое сообщение доставленным
+type NoopSink struct{}
+
+func (NoopSink) Deliver(context.Context, Message) error {
+	return nil
+}
+
+func (NoopSink) DeliverBatch(context.Context, []Message) error {
+	return nil
+}
+
+func (NoopSink) Delete(context.Context, int) error {
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// TestMirrorSinkMirrorsAfterPrimarySuccess проверяет, что отвергнутый основным API факт
+// не дублируется в зеркало, а доставленный дублируется
+func TestMirrorSinkMirrorsAfterPrimarySuccess(t *testing.T) {
+	rejected := errors.New("rejected")
+	primary := &fakeSink{deliver: func(_ context.Context, message Message) error {
+		if message.Value == 1 {
+			return rejected
+		}
+		return nil
+	}}
+	mirror := &fakeSink{}
+	sink := newMirrorSink(primary, mirror)
+
+	if err := sink.Deliver(context.Background(), testFact(0, 7)); !errors.Is(err, rejected) {
+		t.Fatalf("Deliver = %v, want %v", err, rejected)
+	}
+	if err := sink.Deliver(context.Background(), testFact(1, 7)); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+
+	// зеркало пишется в фоне: занимаем все слоты, чтобы дождаться завершения отправок
+	for i := 0; i < maxMirrorInFlight; i++ {
+		sink.inFlight <- struct{}{}
+	}
+	mirrored := mirror.deliveredMessages()
+	if len(mirrored) != 1 || mirrored[0].Value != 2 {
+		t.Errorf("mirrored = %+v, want only the delivered fact", mirrored)
+	}
+}
+
+// TestMirrorHTTPSinkDoesNotSendPrimaryAuth проверяет, что зеркало получает факт методом POST
+// без токена основного API, а с TARGET_MIRROR_TOKEN — со своим
+func TestMirrorHTTPSinkDoesNotSendPrimaryAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		wantAuth string
+	}{
+		{"without mirror token", "", ""},
+		{"with mirror token", "mirror-token", "Bearer mirror-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, auth string
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, auth = r.Method, r.Header.Get("Authorization")
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer mirror.Close()
+
+			cfg := testConfig(t)
+			cfg.TargetToken = "primary-token"
+			cfg.TargetMethod = http.MethodPut
+			cfg.TargetMirrorURL = mirror.URL
+			cfg.TargetMirrorToken = tt.token
+			if err := newMirrorHTTPSink(cfg, http.DefaultTransport).Deliver(context.Background(), testFact(0, 7)); err != nil {
+				t.Fatalf("Deliver: %v", err)
+			}
+
+			if method != http.MethodPost {
+				t.Errorf("mirror method = %s, want POST", method)
+			}
+			if auth != tt.wantAuth {
+				t.Errorf("mirror Authorization = %q, want %q", auth, tt.wantAuth)
+			}
+		})
+	}
+}
+
+// TestHTTPSinkOmitZeroFactID проверяет по запросу, дошедшему до API, что с TARGET_OMIT_ZERO_FACT_ID
+// нулевой indicator_to_mo_fact_id не передается, а ненулевой и без флага передается
+func TestHTTPSinkOmitZeroFactID(t *testing.T) {
+	tests := []struct {
+		name    string
+		omit    bool
+		factID  int
+		present bool
+	}{
+		{"zero omitted", true, 0, false},
+		{"zero sent without flag", false, 0, true},
+		{"non-zero sent with flag", true, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var form url.Values
+			downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("parsing form: %v", err)
+				}
+				form = r.PostForm
+				w.Write([]byte(`{"STATUS":"OK"}`))
+			}))
+			defer downstream.Close()
+
+			sink := NewHTTPSink(downstream.URL, http.MethodPost, "")
+			sink.OmitZeroFactID = tt.omit
+			fact := testFact(0, 7)
+			fact.IndicatorToMoFactID = tt.factID
+			if err := sink.Deliver(context.Background(), fact); err != nil {
+				t.Fatalf("Deliver: %v", err)
+			}
+
+			if _, ok := form["indicator_to_mo_fact_id"]; ok != tt.present {
+				t.Errorf("indicator_to_mo_fact_id present = %v, want %v (form %v)", ok, tt.present, form)
+			}
+			if tt.present && form.Get("indicator_to_mo_fact_id") != strconv.Itoa(tt.factID) {
+				t.Errorf("indicator_to_mo_fact_id = %q, want %d", form.Get("indicator_to_mo_fact_id"), tt.factID)
+			}
+		})
+	}
+}
+
+func TestHTTPSinkBatchOmitZeroFactID(t *testing.T) {
+	var batch []map[string]any
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("decoding batch: %v", err)
+		}
+		w.Write([]byte(`{"STATUS":"OK"}`))
+	}))
+	defer downstream.Close()
+
+	sink := NewHTTPSink(downstream.URL, http.MethodPost, "")
+	sink.BatchURL = downstream.URL
+	sink.OmitZeroFactID = true
+	withID := testFact(1, 7)
+	withID.IndicatorToMoFactID = 5
+	if err := sink.DeliverBatch(context.Background(), []Message{testFact(0, 7), withID}); err != nil {
+		t.Fatalf("DeliverBatch: %v", err)
+	}
+
+	if len(batch) != 2 {
+		t.Fatalf("batch has %d items, want 2", len(batch))
+	}
+	if _, ok := batch[0]["indicator_to_mo_fact_id"]; ok {
+		t.Errorf("zero indicator_to_mo_fact_id sent in batch: %v", batch[0])
+	}
+	if got := batch[1]["indicator_to_mo_fact_id"]; got != float64(5) {
+		t.Errorf("indicator_to_mo_fact_id = %v, want 5", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// supervisor запускает компоненты сервиса (HTTP сервер, consumer) и при падении одного
+// из них отменяет общий контекст, чтобы остальные тоже остановились, а процесс завершился
+// с ошибкой, а не остался работать наполовину
+type supervisor struct {
+	wg     sync.WaitGroup
+	cancel context.CancelCauseFunc
+
+	mu  sync.Mutex
+	err error
+	// компоненты которые еще не завершились, для лога принудительной остановки
+	running map[string]bool
+}
+
+func newSupervisor(parent context.Context) (context.Context, *supervisor) {
+	ctx, cancel := context.WithCancelCause(parent)
+	return ctx, &supervisor{cancel: cancel, running: make(map[string]bool)}
+}
+
+// run запускает компонент в горутине. Паника, ошибка или выход до отмены контекста
+// считаются падением компонента
+func (s *supervisor) run(ctx context.Context, name string, component func(ctx context.Context) error) {
+	s.wg.Add(1)
+	s.mu.Lock()
+	s.running[name] = true
+	s.mu.Unlock()
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, name)
+			s.mu.Unlock()
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				s.fail(fmt.Errorf("%s panicked: %v\n%s", name, r, debug.Stack()))
+			}
+		}()
+
+		err := component(ctx)
+		if err != nil {
+			s.fail(fmt.Errorf("%s: %w", name, err))
+		} else if ctx.Err() == nil {
+			s.fail(fmt.Errorf("%s stopped unexpectedly", name))
+		}
+	}()
+}
+
+func (s *supervisor) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+		log.Printf("Component failed, shutting down: %v\n", err)
+	}
+	s.mu.Unlock()
+	s.cancel(err)
+}
+
+// exitAfter принудительно завершает процесс, если после отмены ctx остановка заняла больше
+// timeout: зависший API или kafka не должны держать процесс дольше, чем ждет оркестратор.
+// inFlight описывает для лога, что еще не дописано
+func (s *supervisor) exitAfter(ctx context.Context, timeout time.Duration, inFlight func() string) {
+	<-ctx.Done()
+	time.Sleep(timeout)
+
+	s.mu.Lock()
+	running := make([]string, 0, len(s.running))
+	for name := range s.running {
+		running = append(running, name)
+	}
+	s.mu.Unlock()
+	slices.Sort(running)
+	if len(running) == 0 {
+		running = append(running, "none")
+	}
+	log.Printf("Shutdown did not complete within SHUTDOWN_TIMEOUT (%s), forcing exit. Still running: %s; %s\n",
+		timeout, strings.Join(running, ", "), inFlight())
+	os.Exit(1)
+}
+
+// wait дожидается остановки всех компонентов и возвращает первую ошибку
+func (s *supervisor) wait() error {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
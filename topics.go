@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// topicSubscription хранит список топиков, на которые подписан consumer.
+// При изменении списка канал changed закрывается, и текущая сессия Consume перезапускается
+type topicSubscription struct {
+	mu      sync.Mutex
+	topics  []string
+	changed chan struct{}
+}
+
+func newTopicSubscription(topics []string) *topicSubscription {
+	return &topicSubscription{topics: topics, changed: make(chan struct{})}
+}
+
+// current возвращает текущий список топиков и канал, который закроется при его изменении
+func (s *topicSubscription) current() ([]string, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.topics, s.changed
+}
+
+// update заменяет список топиков и сообщает об изменении, если список действительно поменялся
+func (s *topicSubscription) update(topics []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Equal(s.topics, topics) {
+		return false
+	}
+	s.topics = topics
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return true
+}
+
+// watchTopics периодически запрашивает список топиков кластера и обновляет подписку
+// топиками подходящими под шаблон. Каждое изменение списка вызывает ребалансировку группы
+func watchTopics(ctx context.Context, cfg Config, config *sarama.Config, subscription *topicSubscription) {
+	var admin sarama.ClusterAdmin
+	defer func() {
+		if admin != nil {
+			admin.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(cfg.TopicRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if admin == nil {
+			var err error
+			admin, err = sarama.NewClusterAdmin(cfg.Brokers, config)
+			if err != nil {
+				log.Printf("Error creating cluster admin for topic refresh: %v\n", err)
+				admin = nil
+			}
+		}
+
+		if admin != nil {
+			matched, err := matchingTopics(admin, cfg.TopicPattern)
+			if err != nil {
+				log.Printf("Error listing topics: %v\n", err)
+			} else if subscription.update(matched) {
+				log.Printf("Topic subscription changed: %v\n", matched)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// matchingTopics возвращает отсортированный список топиков подходящих под шаблон.
+// Служебные топики kafka (с префиксом "__") пропускаются
+func matchingTopics(admin sarama.ClusterAdmin, pattern *regexp.Regexp) ([]string, error) {
+	all, err := admin.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]string, 0, len(all))
+	for topic := range all {
+		if strings.HasPrefix(topic, "__") || !pattern.MatchString(topic) {
+			continue
+		}
+		matched = append(matched, topic)
+	}
+	slices.Sort(matched)
+	return matched, nil
+}
+
+// checkTopicsExist проверяет что топики для чтения существуют. На пустом кластере consumer
+// без топика просто ждет, что выглядит как зависание, поэтому о пропущенных топиках
+// пишем в лог, а при KAFKA_MISSING_TOPICS=fail возвращаем ошибку
+func checkTopicsExist(cfg Config, config *sarama.Config) error {
+	admin, err := sarama.NewClusterAdmin(cfg.Brokers, config)
+	if err != nil {
+		log.Printf("Skipping topic existence check, cannot create cluster admin: %v\n", err)
+		return nil
+	}
+	defer admin.Close()
+
+	existing, err := admin.ListTopics()
+	if err != nil {
+		log.Printf("Skipping topic existence check, cannot list topics: %v\n", err)
+		return nil
+	}
+
+	var missing []string
+	for _, topic := range cfg.Topics {
+		if _, ok := existing[topic]; !ok {
+			missing = append(missing, topic)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if cfg.MissingTopicsPolicy == "fail" {
+		return fmt.Errorf("configured topics do not exist: %v", missing)
+	}
+	log.Printf("WARNING: configured topics do not exist yet, consumer will idle until they are created: %v\n", missing)
+	return nil
+}
+
+// createFailureTopics создает топики повторов и DLQ, если их еще нет. Без них запись на повтор
+// или в DLQ не удалась бы как раз во время сбоя API, когда эти топики нужны
+func createFailureTopics(cfg Config, config *sarama.Config) error {
+	var topics []string
+	for _, topic := range []string{cfg.RetryTopic, cfg.DeadLetterTopic} {
+		if topic != "" && !slices.Contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+
+	admin, err := sarama.NewClusterAdmin(cfg.Brokers, config)
+	if err != nil {
+		return fmt.Errorf("creating cluster admin: %w", err)
+	}
+	defer admin.Close()
+	existing, err := admin.ListTopics()
+	if err != nil {
+		return fmt.Errorf("listing topics: %w", err)
+	}
+
+	for _, topic := range topics {
+		if _, ok := existing[topic]; ok {
+			continue
+		}
+		detail := &sarama.TopicDetail{
+			NumPartitions:     cfg.CreateTopicsPartitions,
+			ReplicationFactor: cfg.CreateTopicsReplication,
+		}
+		// топик мог создать другой экземпляр сервиса между ListTopics и CreateTopic
+		err := admin.CreateTopic(topic, detail, false)
+		if err != nil && !errors.Is(err, sarama.ErrTopicAlreadyExists) {
+			return fmt.Errorf("creating topic %s: %w", topic, err)
+		}
+		log.Printf("Created topic %s\n", topic)
+	}
+	return nil
+}
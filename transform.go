@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Transform изменяет сообщение после чтения из kafka и перед отправкой в API
+type Transform func(Message) Message
+
+// identityTransform отправляет сообщение без изменений
+func identityTransform(message Message) Message {
+	return message
+}
+
+// newTransform возвращает transform выбранный через MESSAGE_TRANSFORM
+func newTransform(name, staticFields string) (Transform, error) {
+	switch name {
+	case "", "identity":
+		return identityTransform, nil
+	case "static":
+		return newStaticFieldsTransform(staticFields)
+	default:
+		return nil, fmt.Errorf("unknown transform %q", name)
+	}
+}
+
+// newStaticFieldsTransform разбирает список "comment=source:buffer,is_plan=0" и возвращает
+// transform, который записывает эти значения в поля сообщения по их json именам
+func newStaticFieldsTransform(spec string) (Transform, error) {
+	messageType := reflect.TypeOf(Message{})
+	fieldIndex := make(map[string]int, messageType.NumField())
+	for i := 0; i < messageType.NumField(); i++ {
+		fieldIndex[messageFieldNames[messageType.Field(i).Name]] = i
+	}
+
+	values := make(map[int]reflect.Value)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, raw, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		key = strings.TrimSpace(key)
+		index, ok := fieldIndex[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", key)
+		}
+
+		switch messageType.Field(index).Type.Kind() {
+		case reflect.String:
+			values[index] = reflect.ValueOf(raw)
+		case reflect.Int:
+			n, err := strconv.Atoi(strings.TrimSpace(raw))
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", key, err)
+			}
+			values[index] = reflect.ValueOf(n)
+		default:
+			return nil, fmt.Errorf("field %q has unsupported type", key)
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no fields configured")
+	}
+
+	return func(message Message) Message {
+		target := reflect.ValueOf(&message).Elem()
+		for index, value := range values {
+			target.Field(index).Set(value)
+		}
+		return message
+	}, nil
+}
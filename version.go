@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/IBM/sarama"
+)
+
+// apiKeyFetch — номер Fetch API в протоколе kafka
+const apiKeyFetch = 1
+
+// fetchVersions сопоставляет максимальную версию Fetch API с версией kafka, в которой она появилась.
+// По ней оценивается версия брокера: точной версии kafka брокер не сообщает
+var fetchVersions = []struct {
+	fetch   int16
+	version sarama.KafkaVersion
+}{
+	{15, sarama.V3_5_0_0},
+	{13, sarama.V3_1_0_0},
+	{12, sarama.V2_7_0_0},
+	{11, sarama.V2_3_0_0},
+	{9, sarama.V2_1_0_0},
+	{8, sarama.V2_0_0_0},
+	{7, sarama.V1_1_0_0},
+	{6, sarama.V1_0_0_0},
+	{4, sarama.V0_11_0_0},
+	{3, sarama.V0_10_1_0},
+	{2, sarama.V0_10_0_0},
+}
+
+// detectKafkaVersion оценивает версию kafka по ApiVersions всех брокеров кластера.
+// Для кластера со смешанными версиями возвращается наименьшая
+func detectKafkaVersion(cfg Config, config *sarama.Config) (sarama.KafkaVersion, error) {
+	// ApiVersions поддерживается с 0.10, запрос с такой версией поймет любой современный брокер
+	probe := *config
+	probe.Version = sarama.V0_10_0_0
+	client, err := sarama.NewClient(cfg.Brokers, &probe)
+	if err != nil {
+		return sarama.KafkaVersion{}, err
+	}
+	defer client.Close()
+
+	var detected *sarama.KafkaVersion
+	for _, broker := range client.Brokers() {
+		if err := broker.Open(&probe); err != nil && !errors.Is(err, sarama.ErrAlreadyConnected) {
+			return sarama.KafkaVersion{}, fmt.Errorf("connecting to broker %s: %w", broker.Addr(), err)
+		}
+		response, err := broker.ApiVersions(&sarama.ApiVersionsRequest{})
+		if err != nil {
+			return sarama.KafkaVersion{}, fmt.Errorf("querying API versions of broker %s: %w", broker.Addr(), err)
+		}
+		version, ok := brokerKafkaVersion(response)
+		if !ok {
+			return sarama.KafkaVersion{}, fmt.Errorf("broker %s does not report a Fetch API version", broker.Addr())
+		}
+		if detected == nil || !version.IsAtLeast(*detected) {
+			detected = &version
+		}
+	}
+	if detected == nil {
+		return sarama.KafkaVersion{}, errors.New("no brokers available")
+	}
+	return *detected, nil
+}
+
+func brokerKafkaVersion(response *sarama.ApiVersionsResponse) (sarama.KafkaVersion, bool) {
+	for _, key := range response.ApiKeys {
+		if key.ApiKey != apiKeyFetch {
+			continue
+		}
+		for _, known := range fetchVersions {
+			if key.MaxVersion >= known.fetch {
+				return known.version, true
+			}
+		}
+		return sarama.V0_8_2_0, true
+	}
+	return sarama.KafkaVersion{}, false
+}
+
+// resolveKafkaVersion сверяет KAFKA_VERSION с брокерами: при KAFKA_VERSION=auto использует
+// оцененную версию (но не выше поддерживаемой sarama), иначе предупреждает если брокеры старше
+// настроенной версии. Недоступность брокеров не мешает запуску, подключение повторится позже
+func resolveKafkaVersion(cfg Config, config *sarama.Config) {
+	detected, err := detectKafkaVersion(cfg, config)
+	if err != nil {
+		log.Printf("Unable to detect Kafka broker version: %v. Using %s\n", err, config.Version)
+		return
+	}
+
+	if cfg.KafkaVersionAuto {
+		if !sarama.MaxVersion.IsAtLeast(detected) {
+			detected = sarama.MaxVersion
+		}
+		config.Version = detected
+		log.Printf("Detected Kafka version %s\n", detected)
+		return
+	}
+	if !detected.IsAtLeast(config.Version) {
+		log.Printf("KAFKA_VERSION is %s but the brokers support up to about %s; "+
+			"set KAFKA_VERSION=%s or KAFKA_VERSION=auto if consuming fails with protocol errors\n",
+			config.Version, detected, detected)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// сколько сообщений может ждать в очереди одного обработчика, прежде чем чтение партиции встанет
+const keyedWorkerQueueSize = 64
+
+// trackedMessage — сообщение партиции в обработке. Обработчик записывает ok и возвращает его
+// через канал done, дальше его меняет только горутина consumeKeyed
+type trackedMessage struct {
+	message *sarama.ConsumerMessage
+	done    bool
+	// сообщение можно пометить: доставлено, записано на повтор или в DLQ
+	ok bool
+}
+
+// offsetTracker следит за сообщениями, которые обрабатываются параллельно и завершаются
+// не по порядку. Пометка смещения N помечает и все до него, поэтому помечать можно только
+// когда все предыдущие сообщения завершены
+type offsetTracker struct {
+	inFlight []*trackedMessage
+}
+
+func (t *offsetTracker) add(message *sarama.ConsumerMessage) *trackedMessage {
+	tracked := &trackedMessage{message: message}
+	t.inFlight = append(t.inFlight, tracked)
+	return tracked
+}
+
+// complete отмечает сообщение завершенным и возвращает последнее сообщение из успешно
+// завершенного начала очереди, которое можно пометить, или nil. Неуспешное сообщение бывает
+// только при завершении сессии: оно остается в начале очереди, и дальше него ничего не
+// помечается, чтобы следующая сессия прочитала его заново
+func (t *offsetTracker) complete(tracked *trackedMessage) *sarama.ConsumerMessage {
+	tracked.done = true
+	var mark *sarama.ConsumerMessage
+	for len(t.inFlight) > 0 && t.inFlight[0].done && t.inFlight[0].ok {
+		mark = t.inFlight[0].message
+		t.inFlight = t.inFlight[1:]
+	}
+	return mark
+}
+
+// workerFor выбирает обработчик по ключу сообщения (factKey), чтобы факты одного показателя шли по порядку.
+// Сообщения без ключа распределяются по смещению
+func workerFor(message *sarama.ConsumerMessage, workers int) int {
+	if message.Key == nil {
+		return int(message.Offset % int64(workers))
+	}
+	hash := fnv.New32a()
+	hash.Write(message.Key)
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// consumeKeyed обрабатывает партицию CONSUMER_WORKERS обработчиками: сообщения с одним ключом
+// попадают к одному обработчику и доставляются по порядку, с разными — параллельно
+func (consumer *Consumer) consumeKeyed(ctx context.Context, messages <-chan *sarama.ConsumerMessage, commits *offsetCommitter) error {
+	done := make(chan *trackedMessage)
+	queues := make([]chan *trackedMessage, consumer.cfg.ConsumerWorkers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan *trackedMessage, keyedWorkerQueueSize)
+		wg.Add(1)
+		go func(queue <-chan *trackedMessage) {
+			defer wg.Done()
+			for tracked := range queue {
+				// после остановки оставшиеся в очереди сообщения не отправляются и не уходят
+				// на повтор: непомеченные, они будут прочитаны заново следующей сессией
+				if ctx.Err() == nil {
+					tracked.ok = consumer.redeliver(ctx, tracked.message)
+				}
+				done <- tracked
+			}
+		}(queues[i])
+	}
+
+	var tracker offsetTracker
+	complete := func(tracked *trackedMessage) {
+		if message := tracker.complete(tracked); message != nil && consumer.cfg.DeliverySemantics == deliveryAtLeastOnce {
+			commits.mark(message)
+		}
+	}
+	// останавливаем обработчики и дожидаемся уже переданных им сообщений, чтобы пометить
+	// их до выхода из партиции
+	stop := func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for tracked := range done {
+			complete(tracked)
+		}
+	}
+
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				stop()
+				log.Printf("message channel was closed")
+				return nil
+			}
+			consumer.reconciliation.consumed(message)
+
+			if consumer.cfg.DeliverySemantics == deliveryAtMostOnce {
+				commits.mark(message)
+			}
+
+			// очередь обработчика может быть полна, пока ждем — принимаем результаты остальных
+			tracked := tracker.add(message)
+			queue := queues[workerFor(message, len(queues))]
+		dispatch:
+			for {
+				select {
+				case queue <- tracked:
+					break dispatch
+				case result := <-done:
+					complete(result)
+				case <-ctx.Done():
+					stop()
+					return nil
+				}
+			}
+
+		case result := <-done:
+			complete(result)
+
+		case <-commits.tick():
+			commits.commit()
+
+		case <-ctx.Done():
+			stop()
+			return nil
+		}
+	}
+}
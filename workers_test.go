@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// TestConsumeKeyedPreservesOrderPerKey доставляет факты нескольких показателей с
+// CONSUMER_WORKERS и случайными задержками API: факты одного показателя должны прийти
+// в порядке смещений, а разные показатели — доставляться параллельно
+func TestConsumeKeyedPreservesOrderPerKey(t *testing.T) {
+	const messages = 300
+	const indicators = 12
+
+	cfg := testConfig(t)
+	cfg.ConsumerWorkers = 6
+	rng := rand.New(rand.NewSource(42))
+
+	batch := make([]*sarama.ConsumerMessage, messages)
+	delays := make([]time.Duration, messages)
+	for i := range batch {
+		// сообщение собирается так же, как его пишет POST /facts, включая ключ
+		msg, err := newFactMessage(cfg, jsonCodec{}, testFact(int64(i), rng.Intn(indicators)+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch[i] = consumedMessage(t, msg, int64(i))
+		delays[i] = time.Duration(rng.Intn(500)) * time.Microsecond
+	}
+
+	var inFlight, maxInFlight atomic.Int32
+	var mu sync.Mutex
+	order := make(map[int][]int)
+	sink := &fakeSink{deliver: func(ctx context.Context, message Message) error {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+
+		offset := message.Value - 1
+		time.Sleep(delays[offset])
+		mu.Lock()
+		order[message.IndicatorToMoID] = append(order[message.IndicatorToMoID], offset)
+		mu.Unlock()
+		return nil
+	}}
+
+	marker := &fakeMarker{}
+	consumeAll(t, newTestConsumer(cfg, sink, &fakeProducer{}), marker, batch...)
+
+	delivered := 0
+	for indicator, offsets := range order {
+		delivered += len(offsets)
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Errorf("indicator %d: offset %d delivered after %d", indicator, offsets[i], offsets[i-1])
+			}
+		}
+	}
+	if delivered != messages {
+		t.Errorf("delivered %d messages, want %d", delivered, messages)
+	}
+	if maxInFlight.Load() < 2 {
+		t.Errorf("max concurrent deliveries = %d, want parallel delivery across keys", maxInFlight.Load())
+	}
+	if got := marker.next(); got != messages {
+		t.Errorf("next offset = %d, want %d", got, messages)
+	}
+}
+
+func TestWorkerForUsesMessageKey(t *testing.T) {
+	first := &sarama.ConsumerMessage{Offset: 1, Key: []byte("42")}
+	second := &sarama.ConsumerMessage{Offset: 2, Key: []byte("42")}
+	if workerFor(first, 8) != workerFor(second, 8) {
+		t.Error("messages with the same key were assigned to different workers")
+	}
+}